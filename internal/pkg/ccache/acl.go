@@ -0,0 +1,190 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// purgeSecretHeader - request header holding the shared purge secret
+const purgeSecretHeader = "X-Purge-Secret"
+
+// purgeSignatureHeader - request header holding the hex encoded hmac-sha256
+// signature of a signed purge request
+const purgeSignatureHeader = "X-Purge-Signature"
+
+// purgeTimestampHeader - request header holding the unix time a signed
+// purge request was signed at
+const purgeTimestampHeader = "X-Purge-Timestamp"
+
+// internalRemoteAddr - remote address of cproxy's own sub requests
+const internalRemoteAddr = ":0"
+
+// purgeACL - networks allowed to send purge and ban requests
+type purgeACL []*net.IPNet
+
+// newPurgeACL - parse cidr ranges, or single addresses, of purge acl,
+// invalid entries are logged and skipped
+func newPurgeACL(entries []string) purgeACL {
+	acl := make(purgeACL, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("CACHE :: PURGE ACL :: ERROR = %s", err.Error())
+			continue
+		}
+		acl = append(acl, network)
+	}
+	return acl
+}
+
+// Allows - check if given remote address is in the acl
+func (a purgeACL) Allows(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayCache - signatures of signed purge requests already seen, kept
+// until their timestamp falls out of the accepted window
+type replayCache struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+}
+
+// newReplayCache - create new empty replay cache
+func newReplayCache() *replayCache {
+	return &replayCache{
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Add - remember signature until given time, returns false if it was
+// already seen
+func (c *replayCache) Add(signature string, until time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for seen, expires := range c.expires {
+		if now.After(expires) {
+			delete(c.expires, seen)
+		}
+	}
+	if _, ok := c.expires[signature]; ok {
+		return false
+	}
+	c.expires[signature] = until
+	return true
+}
+
+// purgeSignedHeaders - names of the request headers covered by the
+// signature of a signed purge request, in order
+func (b *Handler) purgeSignedHeaders() []string {
+	names := []string{b.Config.BanExpressionHeader, b.Config.SoftPurgeHeader, tagRequestHeaderLegacy}
+	names = append(names, b.Config.TagHeaders...)
+	return append(names, b.Config.InvalidateHeaders...)
+}
+
+// PurgeSignature - get signature of purge request signed at given unix
+// time, the hex encoded hmac-sha256 with the purge secret of the method,
+// request uri, timestamp and a 'name:value' line for each header that
+// selects what to purge, these are the ban expression, soft purge, key,
+// tag and invalidate headers in that order, each joined by newlines
+func (b *Handler) PurgeSignature(req *http.Request, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(b.Config.PurgeSecret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n", req.Method, req.URL.RequestURI(), timestamp)
+	for _, name := range b.purgeSignedHeaders() {
+		fmt.Fprintf(mac, "%s:%s\n", strings.ToLower(name), strings.Join(req.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorizePurge - check if purge or ban request is allowed, cproxy's own
+// sub requests always are, others must come from an address in the purge
+// acl and, if a purge secret is configured, carry the secret or a valid
+// signature made with it, returns the reason if not allowed
+func (b *Handler) authorizePurge(req *http.Request) error {
+	if req.RemoteAddr == internalRemoteAddr {
+		return nil
+	}
+	if !b.purgeACL.Allows(req.RemoteAddr) {
+		return fmt.Errorf("address '%s' not in purge acl", req.RemoteAddr)
+	}
+	if b.Config.PurgeSecret == "" {
+		return nil
+	}
+	// shared secret
+	if secret := req.Header.Get(purgeSecretHeader); secret != "" {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(b.Config.PurgeSecret)) != 1 {
+			return errors.New("invalid purge secret")
+		}
+		return nil
+	}
+	// signed request, must be recent and not seen before
+	signature := req.Header.Get(purgeSignatureHeader)
+	if signature == "" {
+		return errors.New("purge secret or signature required")
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(purgeTimestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("invalid purge timestamp")
+	}
+	maxAge := time.Duration(b.Config.PurgeSignatureTTL) * time.Second
+	signedAt := time.Unix(timestamp, 0)
+	if time.Since(signedAt) > maxAge || time.Until(signedAt) > maxAge {
+		return errors.New("purge timestamp outside of accepted window")
+	}
+	signature = strings.ToLower(signature)
+	if !hmac.Equal([]byte(signature), []byte(b.PurgeSignature(req, timestamp))) {
+		return errors.New("invalid purge signature")
+	}
+	if !b.purgeReplays.Add(signature, signedAt.Add(maxAge)) {
+		return errors.New("purge signature already used")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeACLAllows(t *testing.T) {
+	acl := newPurgeACL([]string{"10.0.0.0/8", "192.168.1.5", "2001:db8::/32", "::1", "bogus", "10.0.0.0/99"})
+	if len(acl) != 4 {
+		t.Fatalf("expected invalid entries to be skipped, got %d entries", len(acl))
+	}
+	tests := []struct {
+		remoteAddr string
+		allowed    bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"10.255.255.255:1", true},
+		{"11.0.0.1:1234", false},
+		{"192.168.1.5:1234", true},
+		{"192.168.1.6:1234", false},
+		{"192.168.1.5", true},
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db9::1]:1234", false},
+		{"[::1]:1234", true},
+		{"[::2]:1234", false},
+		{"", false},
+		{"not an address", false},
+	}
+	for _, test := range tests {
+		if allowed := acl.Allows(test.remoteAddr); allowed != test.allowed {
+			t.Errorf("%s: got %t, want %t", test.remoteAddr, allowed, test.allowed)
+		}
+	}
+}
+
+func TestAuthorizePurge(t *testing.T) {
+	config := testConfig(t)
+	config.PurgeACL = []string{"10.0.0.0/8"}
+	config.PurgeSecret = "secret"
+	handler := testHandler(t, config)
+	now := time.Now().Unix()
+	// sign - sign purge request at given unix time
+	sign := func(timestamp int64) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set(purgeTimestampHeader, strconv.FormatInt(timestamp, 10))
+			req.Header.Set(purgeSignatureHeader, handler.PurgeSignature(req, timestamp))
+		}
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		prepare    func(req *http.Request)
+		allowed    bool
+	}{
+		{"internal sub request", internalRemoteAddr, nil, true},
+		{"not in acl", "11.0.0.1:1234", func(req *http.Request) {
+			req.Header.Set(purgeSecretHeader, "secret")
+		}, false},
+		{"no secret", "10.0.0.1:1234", nil, false},
+		{"wrong secret", "10.0.0.1:1234", func(req *http.Request) {
+			req.Header.Set(purgeSecretHeader, "wrong")
+		}, false},
+		{"secret", "10.0.0.1:1234", func(req *http.Request) {
+			req.Header.Set(purgeSecretHeader, "secret")
+		}, true},
+		{"signed", "10.0.0.1:1234", sign(now), true},
+		{"upper case signature", "10.0.0.1:1234", func(req *http.Request) {
+			sign(now - 1)(req)
+			req.Header.Set(purgeSignatureHeader, strings.ToUpper(req.Header.Get(purgeSignatureHeader)))
+		}, true},
+		{"replayed", "10.0.0.1:1234", sign(now), false},
+		{"expired", "10.0.0.1:1234", sign(now - 120), false},
+		{"from the future", "10.0.0.1:1234", sign(now + 120), false},
+		{"invalid timestamp", "10.0.0.1:1234", func(req *http.Request) {
+			sign(now - 2)(req)
+			req.Header.Set(purgeTimestampHeader, "soon")
+		}, false},
+		{"tampered header", "10.0.0.1:1234", func(req *http.Request) {
+			sign(now - 3)(req)
+			req.Header.Set("Xkey", "other")
+		}, false},
+		{"tampered timestamp", "10.0.0.1:1234", func(req *http.Request) {
+			sign(now - 4)(req)
+			req.Header.Set(purgeTimestampHeader, strconv.FormatInt(now-5, 10))
+		}, false},
+		{"wrong secret signature", "10.0.0.1:1234", func(req *http.Request) {
+			req.Header.Set(purgeTimestampHeader, strconv.FormatInt(now, 10))
+			req.Header.Set(purgeSignatureHeader, strings.Repeat("0", 64))
+		}, false},
+	}
+	for _, test := range tests {
+		req := testReq("PURGE", "http://cache.test/page?q=1")
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("Xkey", "news")
+		if test.prepare != nil {
+			test.prepare(req)
+		}
+		err := handler.authorizePurge(req)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: got %v, want allowed %t", test.name, err, test.allowed)
+		}
+	}
+	// denied purge requests are answered with forbidden
+	resp, _ := handler.OnRequest(testPurgeReq("PURGE", "http://cache.test/page", nil))
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected forbidden")
+	}
+}
@@ -0,0 +1,338 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// banFieldURL - ban field, url of the request an item was cached for
+const banFieldURL = "req.url"
+
+// banFieldStatus - ban field, status code of the cached response
+const banFieldStatus = "obj.status"
+
+// banFieldReqHeaderPrefix - ban field prefix, header of the request an
+// item was cached for
+const banFieldReqHeaderPrefix = "req.http."
+
+// banFieldObjHeaderPrefix - ban field prefix, header of the cached response
+const banFieldObjHeaderPrefix = "obj.http."
+
+// banOperators - ban comparison operators, longest first so that '!~' is
+// not read as '!'
+var banOperators = []string{"==", "!=", "!~", "~"}
+
+// banTest - single comparison of a ban expression
+type banTest struct {
+	Field    string
+	Operator string
+	Argument string
+	regex    *regexp.Regexp
+	status   int
+}
+
+// BanExpression - varnish like ban expression, an item is banned if it
+// passes all of the tests
+type BanExpression struct {
+	Source string
+	tests  []banTest
+}
+
+// ParseBanExpression - parse ban expression made of tests joined with
+// '&&', each test is a field (req.url, req.http.<name>, obj.http.<name>
+// or obj.status) an operator (==, !=, ~ or !~) and a, optionally quoted,
+// argument, ie. 'req.url ~ "^/news/" && obj.http.content-type ~ html'
+func ParseBanExpression(source string) (*BanExpression, error) {
+	expr := &BanExpression{
+		Source: source,
+		tests:  make([]banTest, 0),
+	}
+	rest := strings.TrimSpace(source)
+	if rest == "" {
+		return nil, errors.New("empty ban expression")
+	}
+	for {
+		test, remainder, err := parseBanTest(rest)
+		if err != nil {
+			return nil, err
+		}
+		expr.tests = append(expr.tests, test)
+		rest = strings.TrimSpace(remainder)
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, "&&") {
+			return nil, fmt.Errorf("expected '&&' in ban expression at '%s'", rest)
+		}
+		rest = strings.TrimSpace(rest[2:])
+	}
+	return expr, nil
+}
+
+// parseBanTest - parse single test from start of given ban expression,
+// returns the test and the rest of the expression
+func parseBanTest(source string) (banTest, string, error) {
+	test := banTest{}
+	// field
+	end := strings.IndexAny(source, " \t=!~")
+	if end <= 0 {
+		return test, "", fmt.Errorf("expected field in ban expression at '%s'", source)
+	}
+	test.Field = strings.ToLower(source[:end])
+	switch {
+	case test.Field == banFieldURL, test.Field == banFieldStatus:
+		{
+			break
+		}
+	case strings.HasPrefix(test.Field, banFieldReqHeaderPrefix) && len(test.Field) > len(banFieldReqHeaderPrefix),
+		strings.HasPrefix(test.Field, banFieldObjHeaderPrefix) && len(test.Field) > len(banFieldObjHeaderPrefix):
+		{
+			break
+		}
+	default:
+		{
+			return test, "", fmt.Errorf("unknown ban field '%s'", source[:end])
+		}
+	}
+	source = strings.TrimSpace(source[end:])
+	// operator
+	for _, operator := range banOperators {
+		if strings.HasPrefix(source, operator) {
+			test.Operator = operator
+			break
+		}
+	}
+	if test.Operator == "" {
+		return test, "", fmt.Errorf("expected operator in ban expression at '%s'", source)
+	}
+	source = strings.TrimSpace(source[len(test.Operator):])
+	// argument, quoted arguments may contain spaces and '&&'
+	var err error
+	if strings.HasPrefix(source, "\"") {
+		end = 1
+		for end < len(source) && source[end] != '"' {
+			if source[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(source) {
+			return test, "", errors.New("unterminated string in ban expression")
+		}
+		test.Argument, err = strconv.Unquote(source[:end+1])
+		if err != nil {
+			return test, "", fmt.Errorf("invalid string in ban expression, %s", err.Error())
+		}
+		end++
+	} else {
+		end = strings.IndexAny(source, " \t&")
+		if end < 0 {
+			end = len(source)
+		}
+		if end == 0 {
+			return test, "", fmt.Errorf("expected argument in ban expression at '%s'", source)
+		}
+		test.Argument = source[:end]
+	}
+	// compile argument
+	switch test.Operator {
+	case "~", "!~":
+		{
+			if test.Field == banFieldStatus {
+				return test, "", fmt.Errorf("operator '%s' not supported for '%s'", test.Operator, banFieldStatus)
+			}
+			test.regex, err = regexp.Compile(test.Argument)
+			if err != nil {
+				return test, "", fmt.Errorf("invalid regular expression in ban expression, %s", err.Error())
+			}
+			break
+		}
+	default:
+		{
+			if test.Field == banFieldStatus {
+				test.status, err = strconv.Atoi(test.Argument)
+				if err != nil {
+					return test, "", fmt.Errorf("invalid status '%s' in ban expression", test.Argument)
+				}
+			}
+			break
+		}
+	}
+	return test, source[end:], nil
+}
+
+// Match - check if given cache item is banned by this expression
+func (e *BanExpression) Match(item *Item) bool {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	for _, test := range e.tests {
+		if !test.match(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// match - check if given cache item passes test, must hold item lock
+func (t *banTest) match(item *Item) bool {
+	// status is compared as a number
+	if t.Field == banFieldStatus {
+		if t.Operator == "!=" {
+			return item.StatusCode != t.status
+		}
+		return item.StatusCode == t.status
+	}
+	// a header that is not present only passes negated tests
+	value := ""
+	present := true
+	switch {
+	case t.Field == banFieldURL:
+		{
+			value = item.URL
+			break
+		}
+	case strings.HasPrefix(t.Field, banFieldReqHeaderPrefix):
+		{
+			values := item.RequestHeader[http.CanonicalHeaderKey(t.Field[len(banFieldReqHeaderPrefix):])]
+			present = len(values) > 0
+			value = strings.Join(values, ", ")
+			break
+		}
+	case strings.HasPrefix(t.Field, banFieldObjHeaderPrefix):
+		{
+			values := item.Header[http.CanonicalHeaderKey(t.Field[len(banFieldObjHeaderPrefix):])]
+			present = len(values) > 0
+			value = strings.Join(values, ", ")
+			break
+		}
+	}
+	switch t.Operator {
+	case "==":
+		{
+			return present && value == t.Argument
+		}
+	case "!=":
+		{
+			return !present || value != t.Argument
+		}
+	case "~":
+		{
+			return present && t.regex.MatchString(value)
+		}
+	case "!~":
+		{
+			return !present || !t.regex.MatchString(value)
+		}
+	}
+	return false
+}
+
+// banListEntry - ban in the ban list, seq orders bans by the time they
+// were issued
+type banListEntry struct {
+	seq  uint64
+	expr *BanExpression
+}
+
+// banList - time ordered list of bans that cache items are tested against
+// lazily, an item only has to be tested against bans issued after it was
+// added to the cache
+type banList struct {
+	mutex sync.RWMutex
+	bans  []*banListEntry
+	head  uint64
+}
+
+// newBanList - create new empty ban list
+func newBanList() *banList {
+	return &banList{
+		bans: make([]*banListEntry, 0),
+	}
+}
+
+// Add - add ban to the list, returns its seq
+func (l *banList) Add(expr *BanExpression) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.head++
+	l.bans = append(l.bans, &banListEntry{
+		seq:  l.head,
+		expr: expr,
+	})
+	return l.head
+}
+
+// Head - get seq of the newest ban
+func (l *banList) Head() uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.head
+}
+
+// Len - get number of active bans
+func (l *banList) Len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.bans)
+}
+
+// Check - test item against bans issued since it was last tested, returns
+// the expression of the ban that matched or nil if the item is not banned
+func (l *banList) Check(item *Item) *BanExpression {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	item.mutex.RLock()
+	banSeq := item.banSeq
+	item.mutex.RUnlock()
+	if banSeq >= l.head {
+		return nil
+	}
+	for index := len(l.bans) - 1; index >= 0 && l.bans[index].seq > banSeq; index-- {
+		if l.bans[index].expr.Match(item) {
+			return l.bans[index].expr
+		}
+	}
+	// item does not have to be tested against these bans again
+	item.mutex.Lock()
+	if item.banSeq < l.head {
+		item.banSeq = l.head
+	}
+	item.mutex.Unlock()
+	return nil
+}
+
+// Retire - remove bans up to and including given seq, every item added
+// before them must have been tested against them, returns the number of
+// bans removed
+func (l *banList) Retire(seq uint64) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	index := 0
+	for index < len(l.bans) && l.bans[index].seq <= seq {
+		index++
+	}
+	l.bans = append(make([]*banListEntry, 0, len(l.bans)-index), l.bans[index:]...)
+	return index
+}
@@ -0,0 +1,147 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseBanExpression(t *testing.T) {
+	tests := []struct {
+		source string
+		tests  []banTest
+		err    bool
+	}{
+		{`req.url ~ ^/news/`, []banTest{{Field: "req.url", Operator: "~", Argument: "^/news/"}}, false},
+		{`REQ.URL==/a`, []banTest{{Field: "req.url", Operator: "==", Argument: "/a"}}, false},
+		{`obj.status!=404&&req.url!~^/x`, []banTest{
+			{Field: "obj.status", Operator: "!=", Argument: "404"},
+			{Field: "req.url", Operator: "!~", Argument: "^/x"},
+		}, false},
+		{`req.http.x-site == "a && b" && obj.http.content-type ~ "text/\"html\""`, []banTest{
+			{Field: "req.http.x-site", Operator: "==", Argument: "a && b"},
+			{Field: "obj.http.content-type", Operator: "~", Argument: `text/"html"`},
+		}, false},
+		{``, nil, true},
+		{`   `, nil, true},
+		{`foo == 1`, nil, true},
+		{`req.http. == 1`, nil, true},
+		{`req.url`, nil, true},
+		{`req.url =~ a`, nil, true},
+		{`req.url ==`, nil, true},
+		{`req.url == a b`, nil, true},
+		{`req.url == a &&`, nil, true},
+		{`req.url == a || req.url == b`, nil, true},
+		{`req.url == "a`, nil, true},
+		{`req.url ~ "("`, nil, true},
+		{`obj.status ~ 2`, nil, true},
+		{`obj.status == ok`, nil, true},
+	}
+	for _, test := range tests {
+		expr, err := ParseBanExpression(test.source)
+		if (err != nil) != test.err {
+			t.Errorf("'%s': unexpected error %v", test.source, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if len(expr.tests) != len(test.tests) {
+			t.Errorf("'%s': got %d tests, want %d", test.source, len(expr.tests), len(test.tests))
+			continue
+		}
+		for index, want := range test.tests {
+			got := expr.tests[index]
+			if got.Field != want.Field || got.Operator != want.Operator || got.Argument != want.Argument {
+				t.Errorf("'%s': got test %s %s '%s'", test.source, got.Field, got.Operator, got.Argument)
+			}
+		}
+	}
+}
+
+func TestBanExpressionMatch(t *testing.T) {
+	item := &Item{
+		URL:        "/news/1?page=2",
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type": {"text/html"},
+			"X-Multi":      {"a", "b"},
+		},
+		RequestHeader: http.Header{
+			"X-Site": {"main"},
+		},
+	}
+	tests := []struct {
+		source string
+		match  bool
+	}{
+		{`req.url == /news/1?page=2`, true},
+		{`req.url == /news/1`, false},
+		{`req.url != /news/1`, true},
+		{`req.url ~ ^/news/`, true},
+		{`req.url ~ ^/sport/`, false},
+		{`req.url !~ ^/news/`, false},
+		{`req.url !~ ^/sport/`, true},
+		{`obj.status == 200`, true},
+		{`obj.status == 404`, false},
+		{`obj.status != 404`, true},
+		{`obj.http.content-type ~ html`, true},
+		{`obj.http.Content-Type == text/html`, true},
+		{`obj.http.x-multi == "a, b"`, true},
+		{`req.http.x-site == main`, true},
+		{`req.http.x-site != main`, false},
+		// headers that are not present only pass negated tests
+		{`req.http.x-missing == ""`, false},
+		{`req.http.x-missing ~ .*`, false},
+		{`req.http.x-missing != a`, true},
+		{`req.http.x-missing !~ a`, true},
+		// every test has to pass
+		{`req.url ~ ^/news/ && obj.status == 200`, true},
+		{`req.url ~ ^/news/ && obj.status == 404`, false},
+	}
+	for _, test := range tests {
+		expr, err := ParseBanExpression(test.source)
+		if err != nil {
+			t.Errorf("'%s': %s", test.source, err.Error())
+			continue
+		}
+		if match := expr.Match(item); match != test.match {
+			t.Errorf("'%s': got %t, want %t", test.source, match, test.match)
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	bans := newBanList()
+	item := &Item{URL: "/news/1"}
+	news, _ := ParseBanExpression(`req.url ~ ^/news/`)
+	sport, _ := ParseBanExpression(`req.url ~ ^/sport/`)
+	bans.Add(sport)
+	if bans.Check(item) != nil {
+		t.Fatal("item banned by other ban")
+	}
+	// item already tested against the bans, later bans still apply
+	bans.Add(news)
+	if bans.Check(item) != news {
+		t.Fatal("item not banned")
+	}
+	if bans.Retire(1) != 1 || bans.Len() != 1 || bans.Head() != 2 {
+		t.Fatal("unexpected bans left after retiring")
+	}
+}
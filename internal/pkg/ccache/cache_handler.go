@@ -19,6 +19,7 @@ package ccache
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -26,7 +27,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/pquerna/cachecontrol/cacheobject"
@@ -35,195 +36,518 @@ import (
 // Handler - main cache handler
 type Handler struct {
 	Config             Config
-	CacheItems         []Item
-	lastClean          time.Time
-	locked             bool
+	items              *itemIndex
+	collapser          *collapser
+	bans               *banList
+	purgeACL           purgeACL
+	purgeReplays       *replayCache
+	redisMisses        *redisMissCache
+	cleanMutex         sync.Mutex
+	loadWait           sync.WaitGroup
+	janitorStop        chan struct{}
+	janitorDone        chan struct{}
+	janitorWake        chan struct{}
+	janitorOnce        sync.Once
 	subRequestCallback func(req *http.Request) (*http.Response, error)
 }
 
 // NewHandler - create new cache handler
-func NewHandler(config Config, subRequestCallback func(req *http.Request) (*http.Response, error)) Handler {
-	handler := Handler{
+func NewHandler(config Config, subRequestCallback func(req *http.Request) (*http.Response, error)) *Handler {
+	handler := &Handler{
 		Config:             config,
+		items:              newItemIndex(config.EvictionPolicies),
+		collapser:          newCollapser(),
+		bans:               newBanList(),
+		purgeACL:           newPurgeACL(config.PurgeACL),
+		purgeReplays:       newReplayCache(),
+		redisMisses:        newRedisMissCache(),
 		subRequestCallback: subRequestCallback,
 	}
-	handler.Clear()
+	if config.WarmStart {
+		handler.Load()
+	} else {
+		handler.Clear()
+	}
+	handler.startJanitor()
 	return handler
 }
 
-// fetchItem - fetch cache item with key
-func (b *Handler) fetchItem(key string) *Item {
-	if key == "" {
+// fetchItem - fetch variant of cache item with base key selected by request
+func (b *Handler) fetchItem(baseKey string, r *http.Request) *Item {
+	if baseKey == "" {
 		return nil
 	}
-	for index := range b.CacheItems {
-		if b.CacheItems[index].Key == key {
-			if b.CacheItems[index].HasExpired() {
-				continue
-			}
-			return &b.CacheItems[index]
+	item := b.getVariant(baseKey, r)
+	if item == nil || item.HasExpired() {
+		return nil
+	}
+	return b.checkBans(item)
+}
+
+// getVariant - get variant of cache item with base key selected by request,
+// on a miss look it up in redis in case another cache stored it
+func (b *Handler) getVariant(baseKey string, r *http.Request) *Item {
+	item := b.items.GetVariant(baseKey, r)
+	if item != nil || !b.hasStorage(CacheStorageRedis) {
+		return item
+	}
+	// every local miss costs a round trip to redis, don't repeat them for
+	// responses recently not found there, ie. ones that can't be cached
+	if b.redisMisses.Has(baseKey) {
+		return nil
+	}
+	sharedItem := FetchRedisItem(baseKey, r, &b.Config)
+	if sharedItem == nil {
+		b.redisMisses.Add(baseKey, time.Now().Add(time.Duration(b.Config.RedisMissTTL)*time.Second))
+		return nil
+	}
+	// tested against every active ban as it may have been stored before any
+	// of them were issued
+	b.bans.mutex.RLock()
+	item, replacedItems := b.items.Add(sharedItem)
+	b.bans.mutex.RUnlock()
+	for _, replacedItem := range replacedItems {
+		replacedItem.Clear()
+	}
+	b.checkPoolSize(item)
+	return item
+}
+
+// hasStorage - check if storage handler with given name is configured
+func (b *Handler) hasStorage(name string) bool {
+	for _, storageName := range b.Config.CacheStorageHandlers {
+		if storageName == name {
+			return true
 		}
 	}
+	return false
+}
+
+// checkBans - remove cache item if it is banned by any ban issued since
+// it was added, returns nil if it was removed
+func (b *Handler) checkBans(item *Item) *Item {
+	expr := b.bans.Check(item)
+	if expr == nil {
+		return item
+	}
+	item.LogAction("invalidate", "REASON = ban match, "+expr.Source)
+	b.purgeItem(item)
 	return nil
 }
 
 // Fetch - fetch cache item from request
 func (b *Handler) Fetch(r *http.Request) *Item {
 	// look for a private key first
-	item := b.fetchItem(PrivateKeyFromRequest(r, &b.Config))
+	item := b.fetchItem(PrivateKeyFromRequest(r, &b.Config), r)
 	if item != nil {
 		return item
 	}
 	// fallback to public key
-	return b.fetchItem(PublicKeyFromRequest(r, &b.Config))
+	return b.fetchItem(PublicKeyFromRequest(r, &b.Config), r)
 }
 
-// Store - store response if cachable
-func (b *Handler) Store(resp *http.Response) (*Item, error) {
-	// only cache certain request/response types
-	if resp.Request.Method != "GET" || resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, nil
+// fetchStaleItem - fetch expired variant of cache item with base key that
+// passes the given stale check
+func (b *Handler) fetchStaleItem(baseKey string, r *http.Request, canServeStale func(*Item) bool) *Item {
+	if baseKey == "" {
+		return nil
+	}
+	item := b.getVariant(baseKey, r)
+	if item == nil || !canServeStale(item) {
+		return nil
+	}
+	return b.checkBans(item)
+}
+
+// FetchStale - fetch expired cache item from request that can still be
+// served while it is revalidated
+func (b *Handler) FetchStale(r *http.Request) *Item {
+	item := b.fetchStaleItem(PrivateKeyFromRequest(r, &b.Config), r, (*Item).CanServeStale)
+	if item != nil {
+		return item
+	}
+	return b.fetchStaleItem(PublicKeyFromRequest(r, &b.Config), r, (*Item).CanServeStale)
+}
+
+// FetchRevalidate - fetch expired cache item from request that can be
+// revalidated with upstream
+func (b *Handler) FetchRevalidate(r *http.Request) *Item {
+	item := b.fetchStaleItem(PrivateKeyFromRequest(r, &b.Config), r, (*Item).CanRevalidate)
+	if item != nil {
+		return item
+	}
+	return b.fetchStaleItem(PublicKeyFromRequest(r, &b.Config), r, (*Item).CanRevalidate)
+}
+
+// FetchStaleOnError - fetch expired cache item from request that can still
+// be served when upstream fails
+func (b *Handler) FetchStaleOnError(r *http.Request) *Item {
+	item := b.fetchStaleItem(PrivateKeyFromRequest(r, &b.Config), r, (*Item).CanServeStaleOnError)
+	if item != nil {
+		return item
 	}
+	return b.fetchStaleItem(PublicKeyFromRequest(r, &b.Config), r, (*Item).CanServeStaleOnError)
+}
+
+// waitForFetch - wait for another request fetching the same response from
+// upstream, returns the cache item it stored or nil if the caller should
+// fetch the response itself
+func (b *Handler) waitForFetch(r *http.Request) *Item {
+	if b.Config.CollapseTimeout <= 0 {
+		return nil
+	}
+	timeout := time.Duration(b.Config.CollapseTimeout) * time.Second
+	done := b.collapser.Join(PublicKeyFromRequest(r, &b.Config), timeout)
+	if done == nil || !waitFor(done, timeout, r) {
+		return nil
+	}
+	return b.Fetch(r)
+}
+
+// releaseFetch - release requests waiting on the upstream fetch of the
+// response to given request
+func (b *Handler) releaseFetch(req *http.Request, statusCode int, cacheItem *Item) {
+	if req.Method != http.MethodGet || statusCode == http.StatusPartialContent {
+		return
+	}
+	// hit-for-pass, waiters would not be able to use this response
+	pass := time.Duration(0)
+	if cacheItem == nil || cacheItem.Type == CacheItemPrivate {
+		pass = time.Duration(b.Config.HitForPassTTL) * time.Second
+	}
+	b.collapser.Release(PublicKeyFromRequest(req, &b.Config), pass)
+}
+
+// abandonFetch - release requests waiting on the upstream fetch of the
+// response to given request without hit-for-pass, the response could be
+// cached but was not stored, ie. the client went away before reading it in
+// full, so the next request fetches it again
+func (b *Handler) abandonFetch(req *http.Request) {
+	if req.Method != http.MethodGet {
+		return
+	}
+	b.collapser.Release(PublicKeyFromRequest(req, &b.Config), 0)
+}
+
+// getLifetime - get lifetime to cache response with, returns a zero
+// max age if response should not be cached
+func (b *Handler) getLifetime(header http.Header) (itemLifetime, error) {
 	// parse cache control header
-	cacheControl, err := cacheobject.ParseResponseCacheControl(resp.Header.Get("Cache-Control"))
+	cacheControl, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
 	if err != nil {
-		return nil, err
+		return itemLifetime{}, err
 	}
-	// too large
-	if resp.ContentLength > int64(b.Config.ResponseMaxSize) {
-		return nil, nil
+	lifetime := itemLifetime{
+		MaxAge:               int32(cacheControl.MaxAge),
+		StaleWhileRevalidate: int32(cacheControl.StaleWhileRevalidate),
+		StaleIfError:         int32(cacheControl.StaleIfError),
+		Keep:                 int32(b.Config.KeepPeriod),
+	}
+	if lifetime.StaleIfError < int32(b.Config.GracePeriod) {
+		lifetime.StaleIfError = int32(b.Config.GracePeriod)
+	}
+	// must not be served stale once expired
+	if cacheControl.MustRevalidate || cacheControl.ProxyRevalidate {
+		lifetime.StaleWhileRevalidate = 0
+		lifetime.StaleIfError = 0
 	}
-	// check max age, if zero, don't cache
-	cacheMaxAge := int32(cacheControl.MaxAge)
 	if cacheControl.SMaxAge > 0 {
-		cacheMaxAge = int32(cacheControl.SMaxAge)
+		lifetime.MaxAge = int32(cacheControl.SMaxAge)
 	}
 	// no cache
 	if cacheControl.NoCachePresent || cacheControl.NoStore {
-		cacheMaxAge = 0
+		return itemLifetime{}, nil
 	}
 	// configured to not cache private responses
 	if cacheControl.PrivatePresent && !b.Config.CachePrivate {
-		cacheMaxAge = 0
+		return itemLifetime{}, nil
+	}
+	return lifetime, nil
+}
+
+// prepareStore - check if response can be stored, returns the existing
+// cache item if the response is already cached or a new cache item whose
+// response body has yet to be stored
+func (b *Handler) prepareStore(resp *http.Response) (*Item, bool, error) {
+	// only cache certain request/response types, partial responses are
+	// never stored as ranges are served from the full response
+	if resp.Request.Method != "GET" || resp.StatusCode != http.StatusOK {
+		return nil, false, nil
+	}
+	// too large, responses without a content length are checked while
+	// they are stored
+	if resp.ContentLength > int64(b.Config.ResponseMaxSize) {
+		return nil, false, nil
+	}
+	// check max age, if zero and response can't be served stale, don't cache
+	lifetime, err := b.getLifetime(resp.Header)
+	if err != nil {
+		return nil, false, err
+	}
+	if lifetime.MaxAge <= 0 && lifetime.StaleWhileRevalidate <= 0 {
+		return nil, false, nil
 	}
 	// already exists?
 	cacheItem := b.Fetch(resp.Request)
 	if cacheItem != nil {
-		return cacheItem, nil
+		return cacheItem, false, nil
 	}
 	// create cache item
-	newCacheItem, err := ItemFromResponse(resp, &b.Config)
-	if err != nil {
-		return nil, err
+	newCacheItem, err := newItemFromResponse(resp, &b.Config)
+	if err != nil || newCacheItem == nil {
+		return nil, false, err
 	}
 	// set max age
-	newCacheItem.MaxAge = cacheMaxAge
-	// store cache item
-	b.CacheItems = append(b.CacheItems, newCacheItem)
+	newCacheItem.setLifetime(lifetime)
+	return newCacheItem, true, nil
+}
+
+// indexItem - add cache item to the index, it only has to be tested
+// against bans issued after this, the ban list is held so that the ban
+// lurker can't retire a ban before the item can be found in the index
+func (b *Handler) indexItem(item *Item) (*Item, []*Item) {
+	b.bans.mutex.RLock()
+	defer b.bans.mutex.RUnlock()
+	item.mutex.Lock()
+	item.banSeq = b.bans.head
+	item.mutex.Unlock()
+	// item may be moved to redis, look it up there again once it is dropped
+	b.redisMisses.Remove(item.BaseKey)
+	return b.items.Add(item)
+}
+
+// addItem - add new cache item whose response body was stored, another
+// request may have stored the same response in the meantime in which case
+// that item is kept
+func (b *Handler) addItem(newCacheItem *Item, contentLength int64) (*Item, error) {
+	if err := newCacheItem.setStored(contentLength); err != nil {
+		newCacheItem.Clear()
+		return nil, err
+	}
+	cacheItem, replacedCacheItems := b.indexItem(newCacheItem)
+	if cacheItem != newCacheItem {
+		newCacheItem.Clear()
+	}
+	for _, replacedCacheItem := range replacedCacheItems {
+		replacedCacheItem.Clear()
+	}
+	b.checkPoolSize(cacheItem)
+	return cacheItem, nil
+}
+
+// Store - store response if cachable, the response body is read in full
+func (b *Handler) Store(resp *http.Response) (*Item, error) {
+	// not modified response refreshes the existing cache item
+	if resp.Request.Method == http.MethodGet && resp.StatusCode == http.StatusNotModified {
+		return b.storeNotModified(resp)
+	}
+	cacheItem, isNew, err := b.prepareStore(resp)
+	if err != nil || !isNew {
+		return cacheItem, err
+	}
+	return b.storeFull(resp.Body, cacheItem)
+}
+
+// storeNotModified - refresh the cache item a not modified response was
+// sent for, the body in storage is kept as is
+func (b *Handler) storeNotModified(resp *http.Response) (*Item, error) {
+	defer resp.Body.Close()
+	// find cache item, expired or not
+	cacheItem := b.items.GetVariant(PrivateKeyFromRequest(resp.Request, &b.Config), resp.Request)
+	if cacheItem == nil {
+		cacheItem = b.items.GetVariant(PublicKeyFromRequest(resp.Request, &b.Config), resp.Request)
+	}
+	if cacheItem == nil {
+		return nil, nil
+	}
+	// response must be for the stored representation
+	if etag := resp.Header.Get("ETag"); etag != "" && etag != cacheItem.GetHeader("ETag") {
+		return nil, nil
+	}
+	// update stored headers and lifetime
+	header := cacheItem.MergedHeader(resp.Header)
+	lifetime, err := b.getLifetime(header)
 	if err != nil {
 		return nil, err
 	}
-	return &b.CacheItems[len(b.CacheItems)-1], nil
+	cacheItem.Refresh(header, lifetime)
+	cacheItem.LogAction("revalidate", "-")
+	return cacheItem, nil
+}
+
+// removeItem - remove a cache item from the index and clear its storage
+func (b *Handler) removeItem(item *Item) {
+	if b.items.Remove(item) {
+		item.Clear()
+	}
+}
+
+// purgeItem - remove cache item, along with the response stored in redis
+// for its cache key so other caches don't serve it either
+func (b *Handler) purgeItem(item *Item) {
+	b.removeItem(item)
+	if !b.hasStorage(CacheStorageRedis) {
+		return
+	}
+	if err := PurgeRedisItem(item, &b.Config); err != nil {
+		item.LogAction("purge", "ERROR = "+err.Error())
+	}
+}
+
+// purgeShared - remove responses stored in redis for any of the given urls
+// or tags, including those this cache never looked up, soft purges only
+// expire them
+func (b *Handler) purgeShared(urls []string, tags []string, soft bool) {
+	if !b.hasStorage(CacheStorageRedis) {
+		return
+	}
+	var err error
+	if soft {
+		err = ExpireRedisItems(urls, tags, int32(b.Config.SoftPurgeGrace), &b.Config)
+	} else {
+		err = PurgeRedisItems(urls, tags, &b.Config)
+	}
+	if err != nil {
+		log.Printf("CACHE :: PURGE :: redis :: ERROR = %s", err.Error())
+	}
 }
 
-// clearItemIndex - clear a cache item from its index
-func (b *Handler) clearItemIndex(index int) {
-	for b.locked {
+// expireItem - expire cache item, along with the response stored in redis
+// for its cache key, while keeping it to be served stale or revalidated,
+// the next request for it refreshes it from upstream
+func (b *Handler) expireItem(item *Item) {
+	if item.Expire(int32(b.Config.SoftPurgeGrace)) {
+		item.LogAction("invalidate", "REASON = soft purge")
+		b.items.Reschedule(item)
 	}
-	if index < 0 || index > len(b.CacheItems)-1 {
-		b.locked = false
+	if !b.hasStorage(CacheStorageRedis) {
 		return
 	}
-	b.locked = true
-	b.CacheItems[index].Clear()
-	b.CacheItems[index] = b.CacheItems[len(b.CacheItems)-1]
-	b.CacheItems = b.CacheItems[:len(b.CacheItems)-1]
-	b.locked = false
+	if err := ExpireRedisItem(item, int32(b.Config.SoftPurgeGrace), &b.Config); err != nil {
+		item.LogAction("purge", "ERROR = "+err.Error())
+	}
+}
+
+// isSoftPurge - check if purge request should only expire cache items
+func (b *Handler) isSoftPurge(req *http.Request) bool {
+	if req.Method == "SOFTPURGE" {
+		return true
+	}
+	soft, err := strconv.ParseBool(req.Header.Get(b.Config.SoftPurgeHeader))
+	return err == nil && soft
+}
+
+// invalidateItems - remove given cache items, or only expire them if soft
+func (b *Handler) invalidateItems(items []*Item, soft bool, reason string) {
+	for _, item := range items {
+		if soft {
+			b.expireItem(item)
+			continue
+		}
+		item.LogAction("invalidate", "REASON = "+reason)
+		b.purgeItem(item)
+	}
 }
 
-// Invalidate - remove matching items from cache
-func (b *Handler) Invalidate(req *http.Request) {
+// Invalidate - remove matching items from cache, PURGE removes every
+// variant of the object at the request url and BAN adds the ban expression
+// to the ban list or, without one, removes items matching the invalidate
+// headers given, either removes every item tagged with any of the tags
+// given instead, purges are soft, only expiring items, if requested
+func (b *Handler) Invalidate(req *http.Request) error {
 	switch req.Method {
-	case "PURGE", "BAN":
+	case "PURGE", "SOFTPURGE", "BAN":
 		{
-			// TODO need debug logging
-			//log.Println("--", r.Method, r.URL.Path, r.Header)
-			// remove a object found at given url path
-			// TODO, focus on header based invalidate for now
-			/*for index, item := range b.CacheItems {
-				if r.URL.Path == item.Path {
-					item.LogAction("invalidate", "REASON = path match")
-					b.clearItemIndex(index)
-					break
+			soft := b.isSoftPurge(req)
+			// remove any object tagged with any of the tags given
+			tags := TagsFromHeader(req.Header, b.Config.TagHeaders)
+			if len(tags) == 0 {
+				tags = TagsFromHeader(req.Header, []string{tagRequestHeaderLegacy})
+			}
+			if len(tags) > 0 {
+				b.invalidateItems(b.items.FindByTags(tags), soft, "tag match")
+				b.purgeShared(nil, tags, soft)
+				return nil
+			}
+			if req.Method != "BAN" {
+				b.invalidateItems(b.items.FindByURL(URLFromRequest(req)), soft, "purge")
+				b.purgeShared([]string{URLFromRequest(req)}, nil, soft)
+				return nil
+			}
+			// remove any object which match the ban expression
+			if source := req.Header.Get(b.Config.BanExpressionHeader); source != "" {
+				expr, err := ParseBanExpression(source)
+				if err != nil {
+					return err
 				}
-			}*/
+				// cache items are tested against it when they are
+				// looked up or by the ban lurker
+				seq := b.bans.Add(expr)
+				log.Printf("CACHE :: BAN :: %d :: %s", seq, expr.Source)
+				return nil
+			}
 			// remove any object which match any of the ban headers
 			// retrieve ban header key+values
 			invalidateHeaderValues := map[string]string{}
 			for _, key := range b.Config.InvalidateHeaders {
-				reqVal := req.Header.Get(key)
-				switch key {
-				case "Xkey":
-					{
-						if reqVal == "" {
-							reqVal = req.Header.Get("Key")
-						}
-					}
-				}
-				if reqVal != "" {
+				if reqVal := req.Header.Get(key); reqVal != "" {
 					invalidateHeaderValues[key] = reqVal
 				}
 			}
-			// itterate items in cache
-			for index, item := range b.CacheItems {
-				hasInvalidate := false
-				// check invalidate headers
-				if len(invalidateHeaderValues) > 0 {
-					invalidateHeaderMatchCount := 0
-					for key, reqVal := range invalidateHeaderValues {
-						for _, cacheVal := range item.InvalidateHeaders[key] {
-							hasMatch := false
-							switch key {
-							case "Xkey":
-								{
-									if strings.Contains(cacheVal, reqVal) {
-										hasMatch = true
-									}
-									break
-								}
-							default:
-								{
-									if WildcardCompare(cacheVal, reqVal) {
-										hasMatch = true
-										break
-									}
-									regex, err := regexp.Compile(reqVal)
-									if err == nil && regex.MatchString(cacheVal) {
-										hasMatch = true
-									}
-									break
-								}
-							}
-							if hasMatch {
-								invalidateHeaderMatchCount++
-							}
-						}
-					}
-					if invalidateHeaderMatchCount == len(invalidateHeaderValues) {
-						hasInvalidate = true
-						item.LogAction("invalidate", "REASON = header match")
-					}
+			if len(invalidateHeaderValues) == 0 {
+				return errors.New("no tags, ban expression or invalidate headers given")
+			}
+			// look up items matching each of the ban headers, an
+			// item must match all of them to be invalidated
+			matchCounts := map[*Item]int{}
+			for key, reqVal := range invalidateHeaderValues {
+				for _, item := range b.items.FindByHeader(key, invalidateHeaderMatcher(reqVal)) {
+					matchCounts[item]++
 				}
-				// perform ban
-				if hasInvalidate {
-					b.clearItemIndex(index)
-					// check for more invalidations
-					b.Invalidate(req)
-					return
+			}
+			// perform ban
+			matched := make([]*Item, 0, len(matchCounts))
+			for item, matchCount := range matchCounts {
+				if matchCount == len(invalidateHeaderValues) {
+					matched = append(matched, item)
 				}
 			}
+			b.invalidateItems(matched, soft, "header match")
+			return nil
 		}
 	}
+	return nil
+}
+
+// invalidateHeaderMatcher - get function that matches cached invalidate
+// header values against the value given in a ban/purge request
+func invalidateHeaderMatcher(reqVal string) func(cacheVal string) bool {
+	regex, err := regexp.Compile(reqVal)
+	return func(cacheVal string) bool {
+		if WildcardCompare(cacheVal, reqVal) {
+			return true
+		}
+		return err == nil && regex.MatchString(cacheVal)
+	}
+}
+
+// serveItem - get cache item's response for output to given request
+func (b *Handler) serveItem(req *http.Request, cacheItem *Item) (*http.Response, error) {
+	// the stored encoded body can be sent as is unless esi tags have to be
+	// expanded or a byte range sliced from it
+	var resp *http.Response
+	var err error
+	if len(cacheItem.EsiTags) == 0 && req.Header.Get("Range") == "" {
+		resp, err = cacheItem.GetEncodedResponse(req)
+	} else {
+		resp, err = cacheItem.GetResponse()
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	// expand esi
+	return ExpandESI(resp, cacheItem.EsiTags, b.subRequestCallback)
 }
 
 // OnRequest - handle incomming request
@@ -234,7 +558,7 @@ func (b *Handler) OnRequest(req *http.Request) (*http.Response, error) {
 	}
 	// handle request
 	switch req.Method {
-	case "BAN", "PURGE":
+	case "BAN", "PURGE", "SOFTPURGE":
 		{
 			body := ""
 			resp := &http.Response{
@@ -249,44 +573,90 @@ func (b *Handler) OnRequest(req *http.Request) (*http.Response, error) {
 				Header:        make(http.Header, 0),
 			}
 			resp.Header.Set("Content-Type", "text/plain")
-			// ensure valid host
-			// must be localhost, TODO extend this?
-			if req.RemoteAddr != ":0" {
-				resp.Status = "405 Not Allowed"
-				resp.StatusCode = 405
+			// ensure client is allowed to invalidate
+			if err := b.authorizePurge(req); err != nil {
+				log.Printf("CACHE :: %s :: %s :: DENIED = %s", req.Method, req.URL.Path, err.Error())
+				resp.Status = "403 Forbidden"
+				resp.StatusCode = 403
 				return resp, nil
 			}
 			// invalidate
-			b.Invalidate(req)
+			if err := b.Invalidate(req); err != nil {
+				log.Printf("CACHE :: %s :: %s :: ERROR = %s", req.Method, req.URL.Path, err.Error())
+				body = err.Error()
+				resp.Status = "400 Bad Request"
+				resp.StatusCode = 400
+				resp.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+				resp.ContentLength = int64(len(body))
+			}
 			return resp, nil
 		}
 	case http.MethodGet:
 		{
-			// clean cache
-			b.Clean()
+			// refresh sub request, always fetch from upstream
+			if b.isRevalidateRequest(req) {
+				return nil, nil
+			}
 			// get cache item
 			cacheItem := b.Fetch(req)
-			// none exist, no cache
+			// none exist, serve stale while fetching a fresh copy in the background
+			isStale := false
 			if cacheItem == nil {
-				return nil, nil
+				cacheItem = b.FetchStale(req)
+				if cacheItem != nil {
+					isStale = true
+					b.refreshItemAsync(req, cacheItem)
+				}
+			}
+			// none exist, revalidate expired item with a conditional request
+			if cacheItem == nil {
+				if staleItem := b.FetchRevalidate(req); staleItem != nil {
+					cacheItem = b.revalidateItem(req, staleItem)
+				}
 			}
-			// get response from cache
-			resp, err := cacheItem.GetResponse()
-			if err != nil {
-				return nil, err
+			// none exist, wait for any request already fetching it
+			if cacheItem == nil {
+				cacheItem = b.waitForFetch(req)
 			}
-			resp.Request = req
-			// expand esi
-			resp, err = ExpandESI(resp, cacheItem.EsiTags, b.subRequestCallback)
-			if err != nil {
-				return nil, err
+			// no cache, fetch full response for byte range requests
+			if cacheItem == nil {
+				holdRange(req)
+				return nil, nil
+			}
+			// client already has the cached response, no need to read it
+			// from storage
+			var resp *http.Response
+			if cacheItem.IsNotModified(req) {
+				resp = cacheItem.GetNotModifiedResponse(req)
+			} else {
+				// get response from cache, item may have been replaced or
+				// removed since it was fetched in which case treat as a miss
+				var err error
+				resp, err = b.serveItem(req, cacheItem)
+				if err != nil {
+					cacheItem.LogAction("fetch", "ERROR = "+err.Error())
+					b.removeItem(cacheItem)
+					holdRange(req)
+					return nil, nil
+				}
+				// slice cached response if client asked for a byte range
+				resp, err = ServeRange(req, resp)
+				if err != nil {
+					return nil, err
+				}
 			}
 			// update cache hit count and set cache response headers
-			cacheItem.Hits++
-			cacheItem.LastHit = time.Now()
+			hits := cacheItem.Hit()
+			b.items.Touch(cacheItem)
+			b.promoteItem(cacheItem)
 			resp.Header.Set("X-Cache", "HIT")
-			resp.Header.Set("X-Cache-Count", strconv.Itoa(cacheItem.Hits))
-			cacheItem.LogAction("fetch", fmt.Sprintf("COUNT = %d", cacheItem.Hits))
+			resp.Header.Set("X-Cache-Count", strconv.Itoa(hits))
+			resp.Header.Set("Age", strconv.Itoa(cacheItem.Age()))
+			if isStale {
+				resp.Header.Set("X-Cache", "STALE")
+				resp.Header.Set("Warning", `110 - "Response is Stale"`)
+			}
+			cacheItem.LogAction("fetch", fmt.Sprintf("COUNT = %d", hits))
 			return resp, nil
 		}
 	}
@@ -299,92 +669,204 @@ func (b *Handler) OnResponse(resp *http.Response) (*http.Response, error) {
 	if resp.Request == nil {
 		return resp, nil
 	}
-	// store response in cache if able
-	cacheItem, err := b.Store(resp)
-	if err != nil {
-		return nil, err
-	}
-	if cacheItem == nil {
+	restoreRange(resp.Request)
+	// refresh sub request, stored by the refresh itself
+	if b.isRevalidateRequest(resp.Request) {
 		return resp, nil
 	}
-	// retrieve stored response for output
+	// upstream error, serve stale copy if one is available
+	if resp.StatusCode >= 500 && resp.Request.Method == http.MethodGet {
+		if cacheItem := b.FetchStaleOnError(resp.Request); cacheItem != nil {
+			staleResp, err := b.serveItem(resp.Request, cacheItem)
+			if err == nil {
+				b.releaseFetch(resp.Request, resp.StatusCode, nil)
+				resp.Body.Close()
+				cacheItem.LogAction("fetch", fmt.Sprintf("REASON = upstream error %d", resp.StatusCode))
+				staleResp.Header.Set("X-Cache", "STALE")
+				staleResp.Header.Set("X-Cache-Count", strconv.Itoa(cacheItem.Hit()))
+				staleResp.Header.Set("Age", strconv.Itoa(cacheItem.Age()))
+				staleResp.Header.Set("Warning", `111 - "Revalidation Failed"`)
+				return staleResp, nil
+			}
+		}
+	}
+	// not modified response refreshes the cache item, it was for the
+	// client's own conditional request
 	req := resp.Request
-	resp, err = cacheItem.GetResponse()
-	if err != nil {
-		return nil, err
+	if req.Method == http.MethodGet && resp.StatusCode == http.StatusNotModified {
+		cacheItem, err := b.storeNotModified(resp)
+		if cacheItem != nil {
+			b.releaseFetch(req, resp.StatusCode, cacheItem)
+		} else {
+			// nothing stored to refresh, the response only matched the
+			// client's validators and says nothing about being cacheable
+			b.abandonFetch(req)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
 	}
-	resp.Request = req
-	// expand esi
-	resp, err = ExpandESI(resp, cacheItem.EsiTags, b.subRequestCallback)
+	// store response in cache if able
+	statusCode := resp.StatusCode
+	cacheItem, isNew, err := b.prepareStore(resp)
+	if err != nil || cacheItem == nil {
+		b.releaseFetch(req, statusCode, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+	if isNew && len(cacheItem.EsiTags) == 0 {
+		// response body is stored while it streams to the client
+		storeBody := b.newStoreBody(resp.Body, cacheItem, func(storedItem *Item, uncacheable bool) {
+			if storedItem == nil && !uncacheable {
+				b.abandonFetch(req)
+				return
+			}
+			b.releaseFetch(req, statusCode, storedItem)
+		})
+		// client only reads the byte range it asked for, store the rest
+		// of the body anyway
+		storeBody.drain = req.Header.Get("Range") != ""
+		resp.Body = storeBody
+	} else {
+		// esi tags have to be expanded from the stored response
+		if isNew {
+			cacheItem, err = b.storeFull(resp.Body, cacheItem)
+		} else {
+			resp.Body.Close()
+		}
+		if err != nil {
+			b.abandonFetch(req)
+			return nil, err
+		}
+		b.releaseFetch(req, statusCode, cacheItem)
+		if cacheItem == nil {
+			return nil, errStoreAborted
+		}
+		// retrieve stored response for output
+		resp, err = b.serveItem(req, cacheItem)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err = ServeRange(req, resp)
 	if err != nil {
 		return nil, err
 	}
 	// set cache response headers
 	resp.Header.Set("X-Cache", "MISS")
 	resp.Header.Set("X-Cache-Count", "0")
-	// expand ESI into final response
 	return resp, nil
 }
 
-// Clear - clear all cache items
+// Clear - clear all cache items, including those left in the file system
+// cache and s3 by a previous run
 func (b *Handler) Clear() {
+	b.cleanMutex.Lock()
+	defer b.cleanMutex.Unlock()
+	for _, item := range b.items.Reset() {
+		item.Clear()
+	}
 	os.RemoveAll(b.Config.CacheFilePath)
 	os.MkdirAll(b.Config.CacheFilePath, 0770)
-	b.CacheItems = make([]Item, 0)
-	b.lastClean = time.Now()
-	b.locked = false
+	if b.hasStorage(CacheStorageS3) {
+		ClearS3Items(&b.Config)
+	}
 }
 
-// Clean - clean up cache items
-func (b *Handler) Clean() {
-	// time to clean?
-	if time.Now().Add(time.Duration(-b.Config.CleanInterval) * time.Second).Before(b.lastClean) {
-		return
+// Load - load cache items persisted in the file system cache, items in s3
+// are loaded in the background as listing them can take a while, items in
+// redis are looked up when they are requested
+func (b *Handler) Load() {
+	b.cleanMutex.Lock()
+	os.MkdirAll(b.Config.CacheFilePath, 0770)
+	b.indexLoadedItems(LoadItems(&b.Config))
+	b.cleanMutex.Unlock()
+	if b.hasStorage(CacheStorageS3) {
+		b.loadAsync(LoadS3Items)
 	}
-	log.Println("CACHE :: CLEAN")
-	// clear expired
-	hasExpired := true
-	for hasExpired {
-		hasExpired = false
-		for index := range b.CacheItems {
-			if b.CacheItems[index].HasExpired() {
-				b.CacheItems[index].LogAction("invalidate", "REASON = max age expired")
-				b.clearItemIndex(index)
-				hasExpired = true
-				break
-			}
+}
+
+// loadAsync - load cache items with given load function in the background
+func (b *Handler) loadAsync(load func(config *Config) []*Item) {
+	b.loadWait.Add(1)
+	go func() {
+		defer b.loadWait.Done()
+		items := load(&b.Config)
+		b.cleanMutex.Lock()
+		defer b.cleanMutex.Unlock()
+		b.indexLoadedItems(items)
+	}()
+}
+
+// indexLoadedItems - add loaded cache items to the index, must hold clean lock
+func (b *Handler) indexLoadedItems(items []*Item) {
+	for _, item := range items {
+		cacheItem, replacedCacheItems := b.indexItem(item)
+		if cacheItem != item {
+			item.Clear()
+		}
+		for _, replacedCacheItem := range replacedCacheItems {
+			replacedCacheItem.Clear()
 		}
 	}
-	// split cache storage in to different pools for each cache type (public/private)
-	// and for each storage handler (memory/file)
-	cacheTypes := []string{CacheItemPublic, CacheItemPrivate}
-	for cacheTypeIndex, cacheType := range cacheTypes {
-		for _, cacheStorageHandler := range b.Config.CacheStorageHandlers {
-			// check size of pool
-			cacheSize := int64(0)
-			for index := range b.CacheItems {
-				if b.CacheItems[index].Type == cacheType && b.CacheItems[index].GetStorageType() == cacheStorageHandler {
-					cacheSize += b.CacheItems[index].Size
-				}
-			}
-			// cache reached max size, clear oldest items
-			for cacheSize > int64(b.Config.CacheMaxSize[cacheType][cacheStorageHandler]) {
-				// find oldest item
-				oldestItemIndex := -1
-				for index, item := range b.CacheItems {
-					if oldestItemIndex < 0 || item.LastHit.Before(b.CacheItems[oldestItemIndex].LastHit) {
-						oldestItemIndex = index
-					}
-				}
-				// move oldest item to next storage handler OR delete if last storage handler
-				cacheSize -= b.CacheItems[oldestItemIndex].Size
-				if cacheTypeIndex+1 < len(cacheTypes) {
-					b.CacheItems[oldestItemIndex].MoveStorage(b.Config.CacheStorageHandlers[cacheTypeIndex+1], &b.Config)
-				}
-				// clear from cache
-				b.clearItemIndex(oldestItemIndex)
+}
+
+// Close - stop background maintenance and persist cache items so they
+// can be loaded on next start, or clear them if warm start is disabled
+func (b *Handler) Close() {
+	b.stopJanitor()
+	b.loadWait.Wait()
+	if !b.Config.WarmStart {
+		b.Clear()
+		return
+	}
+	hasFileStorage := b.hasStorage(CacheStorageFile)
+	for _, item := range b.items.List() {
+		// memory cache would be lost, move it to the file system
+		if hasFileStorage && item.GetStorageType() == CacheStorageMemory && !item.CanDiscard() {
+			if err := item.MoveStorage(CacheStorageFile, &b.Config); err != nil {
+				item.LogAction("persist", "ERROR = "+err.Error())
 			}
+			continue
 		}
+		// metadata in redis is shared, it may since have been replaced by
+		// another cache
+		if item.GetStorageType() == CacheStorageRedis {
+			continue
+		}
+		if err := item.Persist(); err != nil {
+			item.LogAction("persist", "ERROR = "+err.Error())
+		}
+	}
+}
+
+// promoteItem - move frequently hit item back to the first storage handler
+func (b *Handler) promoteItem(item *Item) {
+	if b.Config.PromoteHits <= 0 || len(b.Config.CacheStorageHandlers) == 0 {
+		return
 	}
-	b.lastClean = time.Now()
+	storageName := b.Config.CacheStorageHandlers[0]
+	if item.GetStorageType() == storageName || item.GetStorageHits() < b.Config.PromoteHits {
+		return
+	}
+	key := "promote:" + item.Key
+	if b.collapser.Join(key, refreshTimeout) != nil {
+		return
+	}
+	go func() {
+		defer b.collapser.Release(key, 0)
+		if err := item.MoveStorage(storageName, &b.Config); err != nil {
+			item.LogAction("move", "ERROR = "+err.Error())
+			b.removeItem(item)
+			return
+		}
+		if !b.items.Repool(item) {
+			item.Clear()
+			return
+		}
+		b.checkPoolSize(item)
+	}()
 }
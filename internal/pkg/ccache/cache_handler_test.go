@@ -0,0 +1,198 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// testPurgeReq - create purge or ban request from an address the purge acl allows
+func testPurgeReq(method string, url string, header map[string]string) *http.Request {
+	req := testReq(method, url)
+	req.RemoteAddr = "127.0.0.1:1234"
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func TestHandlerConcurrent(t *testing.T) {
+	config := testConfig(t)
+	config.CacheMaxSize[CacheItemPublic][CacheStorageMemory] = 200
+	config.CacheMaxSize[CacheItemPublic][CacheStorageFile] = 400
+	handler := testHandler(t, config)
+	// run janitor steps back to back alongside the requests
+	stop := make(chan struct{})
+	var janitor sync.WaitGroup
+	janitor.Add(1)
+	go func() {
+		defer janitor.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				handler.expireItems()
+				handler.lurkBans()
+				handler.enforceSize()
+			}
+		}
+	}()
+	var wait sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := 0; i < 200; i++ {
+				url := fmt.Sprintf("http://cache.test/%d", i%10)
+				switch i % 25 {
+				case 5:
+					{
+						handler.OnRequest(testPurgeReq("PURGE", url, nil))
+						break
+					}
+				case 10:
+					{
+						handler.OnRequest(testPurgeReq("SOFTPURGE", url, nil))
+						break
+					}
+				case 15:
+					{
+						handler.OnRequest(testPurgeReq("BAN", "http://cache.test/", map[string]string{
+							handler.Config.BanExpressionHeader: fmt.Sprintf("req.url ~ ^/%d", worker),
+						}))
+						break
+					}
+				case 20:
+					{
+						handler.OnRequest(testPurgeReq("BAN", "http://cache.test/", map[string]string{
+							"X-Location-Id": fmt.Sprintf("%d", worker%3),
+						}))
+						break
+					}
+				case 22:
+					{
+						handler.OnRequest(testPurgeReq("PURGE", "http://cache.test/", map[string]string{
+							"Xkey": fmt.Sprintf("tag-%d", worker%3),
+						}))
+						break
+					}
+				case 24:
+					{
+						handler.Clean()
+						break
+					}
+				}
+				req := testReq("GET", url)
+				resp, err := handler.OnRequest(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if resp == nil {
+					resp, err = handler.OnResponse(testResp(req, 200, "max-age=60", fmt.Sprintf("body %d", i%10), map[string]string{
+						"X-Location-Id": fmt.Sprintf("%d", i%3),
+						"Xkey":          fmt.Sprintf("tag-%d", i%3),
+					}))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				readBody(t, resp)
+			}
+		}(worker)
+	}
+	wait.Wait()
+	close(stop)
+	janitor.Wait()
+	// every item left can still be served
+	for _, item := range handler.items.List() {
+		resp, err := item.GetResponse()
+		if err != nil {
+			t.Fatalf("item '%s' can not be served, %s", item.Key, err.Error())
+		}
+		readBody(t, resp)
+	}
+}
+
+func TestCollapseConditionalLeader(t *testing.T) {
+	handler := testHandler(t, testConfig(t))
+	// client's own conditional request leads the fetch and gets a 304
+	req := testReq("GET", "http://cache.test/page")
+	req.Header.Set("If-None-Match", `"v1"`)
+	if resp, _ := handler.OnRequest(req); resp != nil {
+		t.Fatal("expected miss")
+	}
+	resp, err := handler.OnResponse(testResp(req, 304, "max-age=60", "", map[string]string{
+		"ETag": `"v1"`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	// response can still be cached, requests for it are collapsed again
+	handler.collapser.mutex.Lock()
+	passes := len(handler.collapser.passes)
+	handler.collapser.mutex.Unlock()
+	if passes != 0 {
+		t.Fatal("expected no hit-for-pass after 304 response")
+	}
+	req = testReq("GET", "http://cache.test/page")
+	if resp, _ := handler.OnRequest(req); resp != nil {
+		t.Fatal("expected miss")
+	}
+	resp, err = handler.OnResponse(testResp(req, 200, "max-age=60", "body", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	resp, _ = handler.OnRequest(testReq("GET", "http://cache.test/page"))
+	if resp == nil || readBody(t, resp) != "body" {
+		t.Fatal("expected cache hit")
+	}
+}
+
+func TestSoftPurgeGrace(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		cache        string
+	}{
+		{"no stale while revalidate", "max-age=60", "STALE"},
+		{"stale while revalidate", "max-age=60, stale-while-revalidate=600", "STALE"},
+		{"must revalidate", "max-age=60, must-revalidate", ""},
+	}
+	for _, test := range tests {
+		handler := testHandler(t, testConfig(t))
+		handler.Store(testResp(testReq("GET", "http://cache.test/soft"), 200, test.cacheControl, "soft", nil))
+		handler.OnRequest(testPurgeReq("SOFTPURGE", "http://cache.test/soft", nil))
+		resp, _ := handler.OnRequest(testReq("GET", "http://cache.test/soft"))
+		cache := ""
+		if resp != nil {
+			cache = resp.Header.Get("X-Cache")
+			readBody(t, resp)
+		}
+		if cache != test.cache {
+			t.Errorf("%s: got '%s', want '%s'", test.name, cache, test.cache)
+		}
+	}
+}
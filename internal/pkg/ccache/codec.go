@@ -0,0 +1,322 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CodecNone - codec name for storing response bodies as is
+const CodecNone = "none"
+
+// CodecGzip - codec name for gzip compression
+const CodecGzip = "gzip"
+
+// CodecZstd - codec name for zstandard compression
+const CodecZstd = "zstd"
+
+// CodecBrotli - codec name for brotli compression
+const CodecBrotli = "brotli"
+
+// Codec - define methods of a codec used to compress response bodies in storage
+type Codec interface {
+	GetName() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GetCodec - get codec from its spec, the codec name optionally followed
+// by a colon and compression level (i.e. gzip:6)
+func GetCodec(spec string) (Codec, error) {
+	name := spec
+	level := 0
+	hasLevel := false
+	if index := strings.Index(spec, ":"); index >= 0 {
+		name = spec[:index]
+		var err error
+		level, err = strconv.Atoi(spec[index+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression level in codec '%s'", spec)
+		}
+		hasLevel = true
+	}
+	switch name {
+	case CodecNone, "":
+		{
+			return noneCodec{}, nil
+		}
+	case CodecGzip:
+		{
+			if !hasLevel {
+				level = gzip.DefaultCompression
+			}
+			if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+				return nil, fmt.Errorf("invalid compression level in codec '%s'", spec)
+			}
+			return gzipCodec{level: level}, nil
+		}
+	case CodecZstd:
+		{
+			if !hasLevel {
+				level = 3
+			}
+			return zstdCodec{level: zstd.EncoderLevelFromZstd(level)}, nil
+		}
+	case CodecBrotli:
+		{
+			if !hasLevel {
+				level = brotli.DefaultCompression
+			}
+			if level < brotli.BestSpeed || level > brotli.BestCompression {
+				return nil, fmt.Errorf("invalid compression level in codec '%s'", spec)
+			}
+			return brotliCodec{level: level}, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find codec '%s'", spec)
+}
+
+// noneCodec - stores response bodies as is
+type noneCodec struct{}
+
+// GetName - get codec name
+func (c noneCodec) GetName() string {
+	return CodecNone
+}
+
+// NewWriter - get writer that writes to w as is
+func (c noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+// NewReader - get reader that reads from r as is
+func (c noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+// gzipCodec - gzip compression
+type gzipCodec struct {
+	level int
+}
+
+// GetName - get codec name
+func (c gzipCodec) GetName() string {
+	return CodecGzip
+}
+
+// NewWriter - get writer that compresses to w
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+// NewReader - get reader that decompresses from r
+func (c gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdCodec - zstandard compression
+type zstdCodec struct {
+	level zstd.EncoderLevel
+}
+
+// GetName - get codec name
+func (c zstdCodec) GetName() string {
+	return CodecZstd
+}
+
+// NewWriter - get writer that compresses to w
+func (c zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+}
+
+// NewReader - get reader that decompresses from r
+func (c zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// brotliCodec - brotli compression
+type brotliCodec struct {
+	level int
+}
+
+// GetName - get codec name
+func (c brotliCodec) GetName() string {
+	return CodecBrotli
+}
+
+// NewWriter - get writer that compresses to w
+func (c brotliCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return brotli.NewWriterLevel(w, c.level), nil
+}
+
+// NewReader - get reader that decompresses from r
+func (c brotliCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
+
+// nopWriteCloser - writer with a no-op close method
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close - do nothing
+func (w nopWriteCloser) Close() error {
+	return nil
+}
+
+// incompressibleTypes - media types whose content is already compressed
+var incompressibleTypes = []string{
+	"image/*",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// isCompressible - check if a response body with given headers would
+// benefit from being compressed
+func isCompressible(header http.Header) bool {
+	// already encoded by origin
+	if encoding := strings.TrimSpace(header.Get("Content-Encoding")); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return true
+	}
+	// svg is text
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, incompressibleType := range incompressibleTypes {
+		if WildcardCompare(mediaType, incompressibleType) {
+			return false
+		}
+	}
+	return true
+}
+
+// storageCodec - get spec of codec to store response body with given
+// headers in given storage handler
+func storageCodec(header http.Header, config *Config, storageName string) string {
+	if !isCompressible(header) {
+		return CodecNone
+	}
+	spec := config.CacheCodecs[storageName]
+	if spec == "" {
+		return CodecNone
+	}
+	if _, err := GetCodec(spec); err != nil {
+		log.Printf("CACHE :: CODEC :: %s :: ERROR = %s", storageName, err.Error())
+		return CodecNone
+	}
+	return spec
+}
+
+// sameCodec - check if two codec specs use the same codec, compression
+// level is ignored as it is not needed to decode
+func sameCodec(a string, b string) bool {
+	codecA, errA := GetCodec(a)
+	codecB, errB := GetCodec(b)
+	return errA == nil && errB == nil && codecA.GetName() == codecB.GetName()
+}
+
+// contentCodings - http content coding of each codec
+var contentCodings = map[string]string{
+	CodecGzip:   "gzip",
+	CodecZstd:   "zstd",
+	CodecBrotli: "br",
+}
+
+// contentCoding - get http content coding of codec with given spec, empty
+// if the codec has none
+func contentCoding(codecSpec string) string {
+	codec, err := GetCodec(codecSpec)
+	if err != nil {
+		return ""
+	}
+	return contentCodings[codec.GetName()]
+}
+
+// acceptsEncoding - check if an accept-encoding header value allows the
+// given content coding
+func acceptsEncoding(acceptEncoding string, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		switch name {
+		case coding:
+			{
+				return quality > 0
+			}
+		case "*":
+			{
+				wildcard = quality > 0
+				break
+			}
+		}
+	}
+	return wildcard
+}
+
+// addVary - add header name to the vary header unless already listed
+func addVary(header http.Header, name string) {
+	for _, value := range header["Vary"] {
+		for _, varyName := range strings.Split(value, ",") {
+			varyName = strings.TrimSpace(varyName)
+			if varyName == "*" || strings.EqualFold(varyName, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
@@ -0,0 +1,129 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// collapseFlight - upstream fetch in progress for a cache key
+type collapseFlight struct {
+	done    chan struct{}
+	expires time.Time
+}
+
+// collapser - collapses concurrent cache misses for the same cache key so
+// that only one upstream fetch per key is in flight
+type collapser struct {
+	mutex   sync.Mutex
+	flights map[string]*collapseFlight
+	passes  map[string]time.Time
+}
+
+// newCollapser - create new request collapser
+func newCollapser() *collapser {
+	return &collapser{
+		flights: make(map[string]*collapseFlight),
+		passes:  make(map[string]time.Time),
+	}
+}
+
+// Join - join the upstream fetch for given key, returns nil if the caller
+// should perform the fetch itself, otherwise a channel that is closed once
+// the fetch in flight has completed
+func (c *collapser) Join(key string, timeout time.Duration) <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	// hit-for-pass, key recently produced an uncacheable response
+	if passExpires, ok := c.passes[key]; ok {
+		if now.Before(passExpires) {
+			return nil
+		}
+		delete(c.passes, key)
+	}
+	// wait for fetch in flight
+	if flight, ok := c.flights[key]; ok && now.Before(flight.expires) {
+		return flight.done
+	}
+	// caller becomes the leader, previous leader (if any) has timed out
+	if flight, ok := c.flights[key]; ok {
+		close(flight.done)
+	}
+	c.flights[key] = &collapseFlight{
+		done:    make(chan struct{}),
+		expires: now.Add(timeout),
+	}
+	return nil
+}
+
+// Release - release all requests waiting on the fetch for given key, if
+// pass is greater than zero then requests for the key will not be
+// collapsed for that duration
+func (c *collapser) Release(key string, pass time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if flight, ok := c.flights[key]; ok {
+		close(flight.done)
+		delete(c.flights, key)
+	}
+	if pass > 0 {
+		c.passes[key] = time.Now().Add(pass)
+	}
+}
+
+// Clean - remove expired flights and hit-for-pass entries
+func (c *collapser) Clean() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for key, flight := range c.flights {
+		if !now.Before(flight.expires) {
+			close(flight.done)
+			delete(c.flights, key)
+		}
+	}
+	for key, passExpires := range c.passes {
+		if !now.Before(passExpires) {
+			delete(c.passes, key)
+		}
+	}
+}
+
+// waitFor - wait for done channel to be closed, returns false if the
+// timeout elapsed or the request was cancelled first
+func waitFor(done <-chan struct{}, timeout time.Duration, r *http.Request) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		{
+			return true
+		}
+	case <-timer.C:
+		{
+			return false
+		}
+	case <-r.Context().Done():
+		{
+			return false
+		}
+	}
+}
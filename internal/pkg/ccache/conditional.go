@@ -0,0 +1,105 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// notModifiedHeaders - stored response headers sent with a not modified response
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// etagWeakMatch - check if two entity tags match using weak comparison
+func etagWeakMatch(a string, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// IsNotModified - check if client's conditional request headers match the
+// cached response, the stored body is not needed to do this
+func (i *Item) IsNotModified(r *http.Request) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	// esi fragments may have changed even if the cached page has not
+	if len(i.EsiTags) > 0 {
+		return false
+	}
+	// if-none-match takes precedence over if-modified-since
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := i.Header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || etagWeakMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(i.Header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(since)
+	}
+	return false
+}
+
+// GetNotModifiedResponse - create not modified response for cache item
+func (i *Item) GetNotModifiedResponse(r *http.Request) *http.Response {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	resp := &http.Response{
+		Status:        "304 Not Modified",
+		StatusCode:    http.StatusNotModified,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+		ContentLength: 0,
+		Request:       r,
+		Header:        make(http.Header),
+	}
+	for _, name := range notModifiedHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := i.Header[name]; ok {
+			resp.Header[name] = append([]string(nil), values...)
+		}
+	}
+	if contentCoding(i.Codec) != "" {
+		addVary(resp.Header, "Accept-Encoding")
+	}
+	return resp
+}
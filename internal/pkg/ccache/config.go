@@ -29,9 +29,40 @@ type Config struct {
 	CleanInterval        int                       `json:"clean_interval"`         // interval in seconds of when to performance cache clean up`
 	VaryHeaders          []string                  `json:"vary_headers"`           // headers that should be used to calculate cache keys
 	InvalidateHeaders    []string                  `json:"invalidate_headers"`     // list of headers to use for cache ban/purge requests
+	TagHeaders           []string                  `json:"tag_headers"`            // response headers listing tags (ie. xkey) to purge cache items by, the same headers list the tags to purge in purge requests
+	PurgeACL             []string                  `json:"purge_acl"`              // cidr ranges or addresses of clients allowed to send purge and ban requests, cproxy's own sub requests are always allowed
+	PurgeSecret          string                    `json:"purge_secret"`           // if set purge and ban requests must also carry this secret or be signed with it
+	PurgeSignatureTTL    int                       `json:"purge_signature_ttl"`    // max age in seconds of the timestamp of a signed purge request
+	BanExpressionHeader  string                    `json:"ban_expression_header"`  // request header holding the expression of a ban request
+	BanLurkerInterval    int                       `json:"ban_lurker_interval"`    // interval in seconds of when to test all cache items against the ban list so bans can be retired
+	SoftPurgeHeader      string                    `json:"soft_purge_header"`      // request header that turns a purge request in to a soft purge when set to true
+	SoftPurgeGrace       int                       `json:"soft_purge_grace"`       // min time in seconds soft purged responses can be served stale while they are refreshed, unless they must revalidate
 	CachePrivate         bool                      `json:"enable_private_cache"`   // whether or not to cache private content (cache-control: private)
 	VaryCookies          []string                  `json:"vary_cookies"`           // list of cookies to use to vary private cache
 	UseESI               bool                      `json:"enable_esi"`             // whether or not to handle ESI tags
+	CollapseTimeout      int                       `json:"collapse_timeout"`       // max time in seconds a cache miss waits on another request fetching the same response, zero to disable
+	HitForPassTTL        int                       `json:"hit_for_pass_ttl"`       // time in seconds to stop collapsing requests for a response that could not be cached
+	GracePeriod          int                       `json:"grace_period"`           // time in seconds to keep expired responses to serve when upstream returns an error
+	KeepPeriod           int                       `json:"keep_period"`            // time in seconds to keep expired responses with an etag or last-modified header for conditional revalidation
+	WarmStart            bool                      `json:"warm_start"`             // whether or not to keep the file system cache between restarts
+	PromoteHits          int                       `json:"promote_hits"`           // number of hits after which an item is moved back to the first cache storage handler, zero to disable
+	EvictionPolicies     map[string]string         `json:"eviction_policies"`      // eviction policy (lru/lfu/tinylfu/gdsf) to use for each cache storage handler
+	CacheCodecs          map[string]string         `json:"cache_codecs"`           // codec (none/gzip/zstd/brotli, optionally followed by :level) to compress responses with in each cache storage handler
+	RedisAddress         string                    `json:"redis_address"`          // address (host:port) of redis server used by the redis storage handler
+	RedisPassword        string                    `json:"redis_password"`         // password of redis server
+	RedisDB              int                       `json:"redis_db"`               // redis database number
+	RedisPrefix          string                    `json:"redis_prefix"`           // prefix of redis keys, caches using the same prefix share cached responses
+	RedisMissTTL         int                       `json:"redis_miss_ttl"`         // time in seconds to not look up a response in redis again after it was not found there, zero to look it up on every local miss
+	MemcachedServers     []string                  `json:"memcached_servers"`      // addresses (host:port) of memcached servers used by the memcached storage handler
+	MemcachedPrefix      string                    `json:"memcached_prefix"`       // prefix of memcached keys
+	S3Endpoint           string                    `json:"s3_endpoint"`            // endpoint (host:port) of s3 compatible object storage used by the s3 storage handler
+	S3Bucket             string                    `json:"s3_bucket"`              // s3 bucket to store responses in
+	S3Prefix             string                    `json:"s3_prefix"`              // prefix of s3 object names, everything under it is deleted when the cache is cleared
+	S3AccessKey          string                    `json:"s3_access_key"`          // s3 access key id
+	S3SecretKey          string                    `json:"s3_secret_key"`          // s3 secret access key
+	S3Region             string                    `json:"s3_region"`              // s3 region, looked up from the bucket if empty
+	S3Secure             bool                      `json:"s3_secure"`              // whether or not to connect to s3 over https
+	StorageMinTTL        map[string]int            `json:"storage_min_ttl"`        // min time in seconds an item must have left to live to be moved to each cache storage handler, it is removed instead
 }
 
 // GetDefaultConfig - get default configuration
@@ -41,20 +72,63 @@ func GetDefaultConfig() Config {
 		CacheFilePath:        "/tmp/cproxy-cache/",
 		CacheMaxSize: map[string]map[string]int{
 			CacheItemPublic: {
-				CacheStorageFile:   1024 * 1024 * 500, // 500MB
-				CacheStorageMemory: 1024 * 1024 * 50,  // 50MB
+				CacheStorageFile:      1024 * 1024 * 500,  // 500MB
+				CacheStorageMemory:    1024 * 1024 * 50,   // 50MB
+				CacheStorageRedis:     1024 * 1024 * 1024, // 1GB
+				CacheStorageMemcached: 1024 * 1024 * 1024, // 1GB
+				CacheStorageS3:        1024 * 1024 * 1024, // 1GB
 			},
 			CacheItemPrivate: {
-				CacheStorageFile:   1024 * 1024 * 100, // 100MB
-				CacheStorageMemory: 1024 * 1024 * 10,  // 10MB
+				CacheStorageFile:      1024 * 1024 * 100, // 100MB
+				CacheStorageMemory:    1024 * 1024 * 10,  // 10MB
+				CacheStorageRedis:     1024 * 1024 * 200, // 200MB
+				CacheStorageMemcached: 1024 * 1024 * 200, // 200MB
+				CacheStorageS3:        1024 * 1024 * 200, // 200MB
 			},
 		},
 		ResponseMaxSize:   1024 * 1024, // 1MB
 		CleanInterval:     300,         // 5 minutes
 		VaryHeaders:       []string{},
-		InvalidateHeaders: []string{"X-Location-Id", "X-User-Hash", "X-Installion-Id", "X-Site-Name", "Xkey"},
+		InvalidateHeaders: []string{"X-Location-Id", "X-User-Hash", "X-Installion-Id", "X-Site-Name"},
 		CachePrivate:      true,
 		VaryCookies:       []string{"eZSESSID*", "PHPSESSID*"},
 		UseESI:            true,
+		CollapseTimeout:   10,
+		HitForPassTTL:     120,
+		GracePeriod:       10,
+		KeepPeriod:        300,
+		WarmStart:         false,
+		PromoteHits:       3,
+		EvictionPolicies: map[string]string{
+			CacheStorageMemory: EvictionLRU,
+			CacheStorageFile:   EvictionLRU,
+		},
+		CacheCodecs: map[string]string{
+			CacheStorageMemory:    CodecGzip,
+			CacheStorageFile:      CodecGzip + ":1",
+			CacheStorageRedis:     CodecGzip + ":1",
+			CacheStorageMemcached: CodecGzip + ":1",
+			CacheStorageS3:        CodecGzip,
+		},
+		RedisAddress:     "localhost:6379",
+		RedisDB:          0,
+		RedisPrefix:      "ccache:",
+		RedisMissTTL:     5,
+		MemcachedServers: []string{"localhost:11211"},
+		MemcachedPrefix:  "ccache:",
+		S3Endpoint:       "localhost:9000",
+		S3Bucket:         "cproxy-cache",
+		S3Prefix:         "ccache/",
+		S3Secure:         true,
+		StorageMinTTL: map[string]int{
+			CacheStorageS3: 60 * 60 * 24, // 1 day
+		},
+		BanExpressionHeader: "X-Ban-Expression",
+		BanLurkerInterval:   10,
+		SoftPurgeHeader:     "X-Soft-Purge",
+		SoftPurgeGrace:      60,
+		TagHeaders:          []string{"Xkey", "Surrogate-Key", "Cache-Tag"},
+		PurgeACL:            []string{"127.0.0.1/32", "::1/128"},
+		PurgeSignatureTTL:   60,
 	}
 }
@@ -19,15 +19,17 @@ package ccache
 
 import (
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"regexp"
+	"strings"
 )
 
 // esiTagRegex - Regex for esi tag
 const esiTagRegex = `(?U)<esi:include.*src=\"(.*)\".*>`
 
 // esiTagRegexCompiled - Compiled esi regex
-var esiTagRegexCompiled *regexp.Regexp
+var esiTagRegexCompiled = regexp.MustCompile(esiTagRegex)
 
 // EsiTag - data about ESI tag
 type EsiTag struct {
@@ -35,21 +37,25 @@ type EsiTag struct {
 	Position int    // position in original response of ESI tag
 }
 
-// ParseESI - parse esi tags from response
+// IsESIContentType - check if a response with given content type can
+// contain esi tags
+func IsESIContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/xml" ||
+		mediaType == "application/xhtml+xml"
+}
+
+// ParseESI - parse esi tags from response body
 func ParseESI(resp *http.Response) (*http.Response, []EsiTag, error) {
 
-	// save original request
-	req := resp.Request
-	// compile regex
-	if esiTagRegexCompiled == nil {
-		var err error
-		esiTagRegexCompiled, err = regexp.Compile(esiTagRegex)
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-	// read response
-	respBytes, err := HTTPResponseToBytes(resp)
+	// read response body
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -81,23 +87,23 @@ func ParseESI(resp *http.Response) (*http.Response, []EsiTag, error) {
 		// increase offset
 		posOffset += match[1] - match[0]
 	}
-	// create new output response
-	outputResp, err := HTTPResponseFromBytes(respBytes)
-	outputResp.Request = req
-	return outputResp, esiTags, nil
+	// replace body with tags removed
+	setResponseBody(resp, respBytes)
+	return resp, esiTags, nil
 
 }
 
 // ExpandESI - take http response and replace esi tags
 func ExpandESI(resp *http.Response, esiTags []EsiTag, subRequestCallback func(req *http.Request) (*http.Response, error)) (*http.Response, error) {
 
-	// must have request attached to response
-	if resp.Request == nil {
+	// must have request attached to response, nothing to do without tags
+	if resp.Request == nil || len(esiTags) == 0 {
 		return resp, nil
 	}
 	req := resp.Request
-	// read response
-	respBytes, err := HTTPResponseToBytes(resp)
+	// read response body
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
@@ -141,9 +147,8 @@ func ExpandESI(resp *http.Response, esiTags []EsiTag, subRequestCallback func(re
 		posOffset += len(esiBodyBytes)
 	}
 
-	// create new output response
-	outputResp, err := HTTPResponseFromBytes(respBytes)
-	outputResp.Request = req
-	return outputResp, err
+	// replace body with expanded body
+	setResponseBody(resp, respBytes)
+	return resp, nil
 
 }
@@ -0,0 +1,434 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"container/heap"
+	"container/list"
+	"hash/fnv"
+)
+
+// EvictionLRU - eviction policy name for least recently used
+const EvictionLRU = "lru"
+
+// EvictionLFU - eviction policy name for least frequently used
+const EvictionLFU = "lfu"
+
+// EvictionTinyLFU - eviction policy name for window tinylfu
+const EvictionTinyLFU = "tinylfu"
+
+// EvictionGDSF - eviction policy name for greedy dual size frequency
+const EvictionGDSF = "gdsf"
+
+// EvictionPolicy - define eviction policy methods, an eviction policy
+// decides which item of a cache pool to evict next, calls are serialized
+// by the cache pool
+type EvictionPolicy interface {
+	Add(item *Item, size int64)
+	Touch(item *Item)
+	Remove(item *Item)
+	Victim() *Item
+}
+
+// GetEvictionPolicy - get an eviction policy from its name
+func GetEvictionPolicy(name string) EvictionPolicy {
+	switch name {
+	case EvictionLRU:
+		{
+			return newLRUPolicy()
+		}
+	case EvictionLFU:
+		{
+			return newLFUPolicy()
+		}
+	case EvictionTinyLFU:
+		{
+			return newTinyLFUPolicy()
+		}
+	case EvictionGDSF:
+		{
+			return newGDSFPolicy()
+		}
+	}
+	return nil
+}
+
+// lruPolicy - evicts least recently used item
+type lruPolicy struct {
+	order    *list.List
+	elements map[*Item]*list.Element
+}
+
+// newLRUPolicy - create new lru eviction policy
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order:    list.New(),
+		elements: make(map[*Item]*list.Element),
+	}
+}
+
+// Add - add item as most recently used
+func (p *lruPolicy) Add(item *Item, size int64) {
+	p.elements[item] = p.order.PushFront(item)
+}
+
+// Touch - mark item as most recently used
+func (p *lruPolicy) Touch(item *Item) {
+	if element, ok := p.elements[item]; ok {
+		p.order.MoveToFront(element)
+	}
+}
+
+// Remove - remove item from policy
+func (p *lruPolicy) Remove(item *Item) {
+	if element, ok := p.elements[item]; ok {
+		p.order.Remove(element)
+		delete(p.elements, item)
+	}
+}
+
+// Victim - get least recently used item
+func (p *lruPolicy) Victim() *Item {
+	if element := p.order.Back(); element != nil {
+		return element.Value.(*Item)
+	}
+	return nil
+}
+
+// priorityEntry - item in a priority queue
+type priorityEntry struct {
+	item     *Item
+	size     int64
+	hits     int64
+	priority float64
+	seq      uint64
+	index    int
+}
+
+// priorityQueue - min heap of items ordered by priority, then by age of last access
+type priorityQueue []*priorityEntry
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(a, b int) bool {
+	if q[a].priority == q[b].priority {
+		return q[a].seq < q[b].seq
+	}
+	return q[a].priority < q[b].priority
+}
+
+func (q priorityQueue) Swap(a, b int) {
+	q[a], q[b] = q[b], q[a]
+	q[a].index = a
+	q[b].index = b
+}
+
+func (q *priorityQueue) Push(x interface{}) {
+	entry := x.(*priorityEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// priorityPolicy - evicts item with lowest priority, priority is
+// calculated from an entry by the priority function
+type priorityPolicy struct {
+	queue    priorityQueue
+	entries  map[*Item]*priorityEntry
+	seq      uint64
+	priority func(entry *priorityEntry) float64
+}
+
+// Add - add item to policy
+func (p *priorityPolicy) Add(item *Item, size int64) {
+	if size < 1 {
+		size = 1
+	}
+	p.seq++
+	entry := &priorityEntry{item: item, size: size, hits: 1, seq: p.seq}
+	entry.priority = p.priority(entry)
+	p.entries[item] = entry
+	heap.Push(&p.queue, entry)
+}
+
+// Touch - count an access to item
+func (p *priorityPolicy) Touch(item *Item) {
+	entry, ok := p.entries[item]
+	if !ok {
+		return
+	}
+	p.seq++
+	entry.hits++
+	entry.seq = p.seq
+	entry.priority = p.priority(entry)
+	heap.Fix(&p.queue, entry.index)
+}
+
+// Remove - remove item from policy
+func (p *priorityPolicy) Remove(item *Item) {
+	entry, ok := p.entries[item]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.queue, entry.index)
+	delete(p.entries, item)
+}
+
+// Victim - get item with lowest priority
+func (p *priorityPolicy) Victim() *Item {
+	if len(p.queue) == 0 {
+		return nil
+	}
+	return p.queue[0].item
+}
+
+// newLFUPolicy - create new eviction policy that evicts the least
+// frequently used item, least recently used first on ties
+func newLFUPolicy() *priorityPolicy {
+	return &priorityPolicy{
+		entries: make(map[*Item]*priorityEntry),
+		priority: func(entry *priorityEntry) float64 {
+			return float64(entry.hits)
+		},
+	}
+}
+
+// gdsfPolicy - greedy dual size frequency, evicts the item with the lowest
+// frequency to size ratio plus an inflation value that ages out items
+// that were popular in the past
+type gdsfPolicy struct {
+	priorityPolicy
+	inflation float64
+}
+
+// newGDSFPolicy - create new greedy dual size frequency eviction policy
+func newGDSFPolicy() *gdsfPolicy {
+	p := &gdsfPolicy{}
+	p.entries = make(map[*Item]*priorityEntry)
+	p.priority = func(entry *priorityEntry) float64 {
+		return p.inflation + float64(entry.hits)*1024/float64(entry.size)
+	}
+	return p
+}
+
+// Victim - get item with lowest priority, the inflation value is raised
+// to its priority
+func (p *gdsfPolicy) Victim() *Item {
+	if len(p.queue) == 0 {
+		return nil
+	}
+	p.inflation = p.queue[0].priority
+	return p.queue[0].item
+}
+
+// frequencySketch - count-min sketch estimating how often cache keys were
+// accessed, counters are halved periodically so old accesses age out
+type frequencySketch struct {
+	counters  [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// sketchWidth - number of counters in each row of the frequency sketch
+const sketchWidth = 1 << 14
+
+// newFrequencySketch - create new frequency sketch
+func newFrequencySketch() *frequencySketch {
+	s := &frequencySketch{
+		mask:    sketchWidth - 1,
+		resetAt: sketchWidth * 10,
+	}
+	for row := range s.counters {
+		s.counters[row] = make([]uint8, sketchWidth)
+	}
+	return s
+}
+
+// indexes - get counter index in each row for key
+func (s *frequencySketch) indexes(key string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	var indexes [4]uint64
+	for row := range indexes {
+		indexes[row] = (sum >> (uint(row) * 16)) & s.mask
+	}
+	return indexes
+}
+
+// Increment - count an access to key
+func (s *frequencySketch) Increment(key string) {
+	for row, index := range s.indexes(key) {
+		if s.counters[row][index] < 255 {
+			s.counters[row][index]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for row := range s.counters {
+			for index := range s.counters[row] {
+				s.counters[row][index] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+// Estimate - estimate number of accesses to key
+func (s *frequencySketch) Estimate(key string) uint8 {
+	estimate := uint8(255)
+	for row, index := range s.indexes(key) {
+		if s.counters[row][index] < estimate {
+			estimate = s.counters[row][index]
+		}
+	}
+	return estimate
+}
+
+// tinyLFU segments
+const (
+	tinyLFUWindow = iota
+	tinyLFUProbation
+	tinyLFUProtected
+)
+
+// tinyLFUEntry - item in a window tinylfu segment
+type tinyLFUEntry struct {
+	element *list.Element
+	segment int
+}
+
+// tinyLFUPolicy - window tinylfu, new items enter a small lru window,
+// items leaving the window are only admitted over the main segmented lru's
+// victim if they have been accessed more often
+type tinyLFUPolicy struct {
+	sketch   *frequencySketch
+	segments [3]*list.List
+	entries  map[*Item]*tinyLFUEntry
+}
+
+// newTinyLFUPolicy - create new window tinylfu eviction policy
+func newTinyLFUPolicy() *tinyLFUPolicy {
+	p := &tinyLFUPolicy{
+		sketch:  newFrequencySketch(),
+		entries: make(map[*Item]*tinyLFUEntry),
+	}
+	for segment := range p.segments {
+		p.segments[segment] = list.New()
+	}
+	return p
+}
+
+// move - move item entry to front of given segment
+func (p *tinyLFUPolicy) move(entry *tinyLFUEntry, segment int) {
+	item := p.segments[entry.segment].Remove(entry.element).(*Item)
+	entry.element = p.segments[segment].PushFront(item)
+	entry.segment = segment
+}
+
+// balance - keep the window at 1% and the protected segment at 80% of items
+func (p *tinyLFUPolicy) balance() {
+	total := len(p.entries)
+	windowMax := total / 100
+	if windowMax < 1 {
+		windowMax = 1
+	}
+	for p.segments[tinyLFUWindow].Len() > windowMax {
+		item := p.segments[tinyLFUWindow].Back().Value.(*Item)
+		p.move(p.entries[item], tinyLFUProbation)
+	}
+	protectedMax := (total - windowMax) * 8 / 10
+	for p.segments[tinyLFUProtected].Len() > protectedMax {
+		item := p.segments[tinyLFUProtected].Back().Value.(*Item)
+		p.move(p.entries[item], tinyLFUProbation)
+	}
+}
+
+// Add - add item to the window
+func (p *tinyLFUPolicy) Add(item *Item, size int64) {
+	p.sketch.Increment(item.Key)
+	p.entries[item] = &tinyLFUEntry{
+		element: p.segments[tinyLFUWindow].PushFront(item),
+		segment: tinyLFUWindow,
+	}
+	p.balance()
+}
+
+// Touch - count an access to item, items in probation are protected
+func (p *tinyLFUPolicy) Touch(item *Item) {
+	entry, ok := p.entries[item]
+	if !ok {
+		return
+	}
+	p.sketch.Increment(item.Key)
+	switch entry.segment {
+	case tinyLFUProbation:
+		{
+			p.move(entry, tinyLFUProtected)
+			p.balance()
+			break
+		}
+	default:
+		{
+			p.segments[entry.segment].MoveToFront(entry.element)
+			break
+		}
+	}
+}
+
+// Remove - remove item from policy
+func (p *tinyLFUPolicy) Remove(item *Item) {
+	entry, ok := p.entries[item]
+	if !ok {
+		return
+	}
+	p.segments[entry.segment].Remove(entry.element)
+	delete(p.entries, item)
+}
+
+// Victim - pick between the window's and the main segments' least recently
+// used items, the one accessed least often is evicted
+func (p *tinyLFUPolicy) Victim() *Item {
+	var candidate, victim *Item
+	if element := p.segments[tinyLFUWindow].Back(); element != nil {
+		candidate = element.Value.(*Item)
+	}
+	if element := p.segments[tinyLFUProbation].Back(); element != nil {
+		victim = element.Value.(*Item)
+	} else if element := p.segments[tinyLFUProtected].Back(); element != nil {
+		victim = element.Value.(*Item)
+	}
+	if candidate == nil {
+		return victim
+	}
+	if victim == nil {
+		return candidate
+	}
+	if p.sketch.Estimate(candidate.Key) > p.sketch.Estimate(victim.Key) {
+		return victim
+	}
+	return candidate
+}
@@ -0,0 +1,104 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryEntry - cache item scheduled to be checked for discard
+type expiryEntry struct {
+	item  *Item
+	at    time.Time
+	index int
+}
+
+// expiryHeap - min heap of expiry entries ordered by time
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(a, b int) bool { return h[a].at.Before(h[b].at) }
+
+func (h expiryHeap) Swap(a, b int) {
+	h[a], h[b] = h[b], h[a]
+	h[a].index = a
+	h[b].index = b
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// expiryQueue - cache items ordered by the time they can be discarded,
+// calls are serialized by the item index
+type expiryQueue struct {
+	heap    expiryHeap
+	entries map[*Item]*expiryEntry
+}
+
+// newExpiryQueue - create new empty expiry queue
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{
+		entries: make(map[*Item]*expiryEntry),
+	}
+}
+
+// Schedule - schedule item to be checked for discard at given time
+func (q *expiryQueue) Schedule(item *Item, at time.Time) {
+	if entry, ok := q.entries[item]; ok {
+		entry.at = at
+		heap.Fix(&q.heap, entry.index)
+		return
+	}
+	entry := &expiryEntry{item: item, at: at}
+	q.entries[item] = entry
+	heap.Push(&q.heap, entry)
+}
+
+// Remove - remove item from queue
+func (q *expiryQueue) Remove(item *Item) {
+	entry, ok := q.entries[item]
+	if !ok {
+		return
+	}
+	heap.Remove(&q.heap, entry.index)
+	delete(q.entries, item)
+}
+
+// Due - remove and get items scheduled at or before given time
+func (q *expiryQueue) Due(now time.Time) []*Item {
+	items := make([]*Item, 0)
+	for len(q.heap) > 0 && !q.heap[0].at.After(now) {
+		entry := heap.Pop(&q.heap).(*expiryEntry)
+		delete(q.entries, entry.item)
+		items = append(items, entry.item)
+	}
+	return items
+}
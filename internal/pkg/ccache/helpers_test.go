@@ -0,0 +1,99 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testConfig - default config with a file system cache in a temporary directory
+func testConfig(t *testing.T) Config {
+	config := GetDefaultConfig()
+	config.CacheFilePath = t.TempDir()
+	config.UseESI = false
+	return config
+}
+
+// testHandler - create cache handler that is closed when the test ends
+func testHandler(t *testing.T, config Config) *Handler {
+	handler := NewHandler(config, func(req *http.Request) (*http.Response, error) {
+		return nil, nil
+	})
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// testReq - create request to given url
+func testReq(method string, url string) *http.Request {
+	return httptest.NewRequest(method, url, nil)
+}
+
+// testResp - create response to given request
+func testResp(req *http.Request, status int, cacheControl string, body string, header map[string]string) *http.Response {
+	resp := &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if cacheControl != "" {
+		resp.Header.Set("Cache-Control", cacheControl)
+	}
+	for name, value := range header {
+		resp.Header.Set(name, value)
+	}
+	return resp
+}
+
+// readBody - read and close response body
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// ageItem - move creation time of cache item by given duration
+func ageItem(item *Item, d time.Duration) {
+	item.mutex.Lock()
+	item.Created = item.Created.Add(d)
+	item.mutex.Unlock()
+}
+
+// waitUntil - wait for work done in the background
+func waitUntil(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
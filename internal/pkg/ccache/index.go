@@ -0,0 +1,341 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// itemSet - set of cache items
+type itemSet map[*Item]struct{}
+
+// itemIndex - concurrent safe index of cache items keyed by cache key
+// with secondary indexes on base key, url, tags and invalidate header
+// values, the cache pool each item is held in and the time it can be
+// discarded
+type itemIndex struct {
+	mutex    sync.RWMutex
+	items    map[string]*Item
+	vary     map[string][]string
+	variants map[string]itemSet
+	urls     map[string]itemSet
+	tags     map[string]itemSet
+	headers  map[string]map[string]itemSet
+	pools    map[string]*cachePool
+	pooled   map[*Item]*cachePool
+	expiry   *expiryQueue
+	policies map[string]string
+}
+
+// newItemIndex - create new empty item index, policies maps storage
+// handler names to the name of the eviction policy used by their pools
+func newItemIndex(policies map[string]string) *itemIndex {
+	x := &itemIndex{
+		policies: policies,
+	}
+	x.reset()
+	return x
+}
+
+// reset - empty all indexes, must hold write lock
+func (x *itemIndex) reset() {
+	x.items = make(map[string]*Item)
+	x.vary = make(map[string][]string)
+	x.variants = make(map[string]itemSet)
+	x.urls = make(map[string]itemSet)
+	x.tags = make(map[string]itemSet)
+	x.headers = make(map[string]map[string]itemSet)
+	x.pools = make(map[string]*cachePool)
+	x.pooled = make(map[*Item]*cachePool)
+	x.expiry = newExpiryQueue()
+}
+
+// pool - get cache pool for given cache type and storage handler, must
+// hold write lock
+func (x *itemIndex) pool(cacheType string, storageName string) *cachePool {
+	name := poolName(cacheType, storageName)
+	if x.pools[name] == nil {
+		policy := GetEvictionPolicy(x.policies[storageName])
+		if policy == nil {
+			policy = GetEvictionPolicy(EvictionLRU)
+		}
+		x.pools[name] = newCachePool(policy)
+	}
+	return x.pools[name]
+}
+
+// link - add item to secondary indexes, must hold write lock
+func (x *itemIndex) link(item *Item) {
+	pool := x.pool(item.Type, item.GetStorageType())
+	pool.Add(item)
+	x.pooled[item] = pool
+	x.expiry.Schedule(item, item.DiscardTime())
+	if x.variants[item.BaseKey] == nil {
+		x.variants[item.BaseKey] = make(itemSet)
+	}
+	x.variants[item.BaseKey][item] = struct{}{}
+	if x.urls[item.URL] == nil {
+		x.urls[item.URL] = make(itemSet)
+	}
+	x.urls[item.URL][item] = struct{}{}
+	for _, tag := range item.Tags {
+		if x.tags[tag] == nil {
+			x.tags[tag] = make(itemSet)
+		}
+		x.tags[tag][item] = struct{}{}
+	}
+	for name, values := range item.InvalidateHeaders {
+		if x.headers[name] == nil {
+			x.headers[name] = make(map[string]itemSet)
+		}
+		for _, value := range values {
+			if x.headers[name][value] == nil {
+				x.headers[name][value] = make(itemSet)
+			}
+			x.headers[name][value][item] = struct{}{}
+		}
+	}
+}
+
+// unlink - remove item from secondary indexes, must hold write lock
+func (x *itemIndex) unlink(item *Item) {
+	if pool := x.pooled[item]; pool != nil {
+		pool.Remove(item)
+		delete(x.pooled, item)
+	}
+	x.expiry.Remove(item)
+	delete(x.variants[item.BaseKey], item)
+	if len(x.variants[item.BaseKey]) == 0 {
+		delete(x.variants, item.BaseKey)
+		delete(x.vary, item.BaseKey)
+	}
+	delete(x.urls[item.URL], item)
+	if len(x.urls[item.URL]) == 0 {
+		delete(x.urls, item.URL)
+	}
+	for _, tag := range item.Tags {
+		delete(x.tags[tag], item)
+		if len(x.tags[tag]) == 0 {
+			delete(x.tags, tag)
+		}
+	}
+	for name, values := range item.InvalidateHeaders {
+		for _, value := range values {
+			delete(x.headers[name][value], item)
+			if len(x.headers[name][value]) == 0 {
+				delete(x.headers[name], value)
+			}
+		}
+		if len(x.headers[name]) == 0 {
+			delete(x.headers, name)
+		}
+	}
+}
+
+// GetVariant - get variant of item with given base key selected by request
+func (x *itemIndex) GetVariant(baseKey string, r *http.Request) *Item {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return x.items[VariantKeyFromRequest(baseKey, r, x.vary[baseKey])]
+}
+
+// Add - add item to index unless an unexpired item with the same key
+// already exists, returns the indexed item and the items it replaced
+func (x *itemIndex) Add(item *Item) (*Item, []*Item) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	old := x.items[item.Key]
+	if old != nil && !old.HasExpired() {
+		return old, nil
+	}
+	replaced := make([]*Item, 0)
+	if old != nil {
+		delete(x.items, old.Key)
+		x.unlink(old)
+		replaced = append(replaced, old)
+	}
+	// origin changed the headers it varies on, existing variants can no
+	// longer be looked up
+	if vary, ok := x.vary[item.BaseKey]; ok && !stringsEqual(vary, item.Vary) {
+		for variant := range x.variants[item.BaseKey] {
+			delete(x.items, variant.Key)
+			x.unlink(variant)
+			replaced = append(replaced, variant)
+		}
+	}
+	x.items[item.Key] = item
+	x.vary[item.BaseKey] = item.Vary
+	x.link(item)
+	return item, replaced
+}
+
+// Remove - remove given item from index, returns false if item was not indexed
+func (x *itemIndex) Remove(item *Item) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.items[item.Key] != item {
+		return false
+	}
+	delete(x.items, item.Key)
+	x.unlink(item)
+	return true
+}
+
+// Pool - get cache pool for given cache type and storage handler
+func (x *itemIndex) Pool(cacheType string, storageName string) *cachePool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.pool(cacheType, storageName)
+}
+
+// Touch - mark item as most recently used in its cache pool
+func (x *itemIndex) Touch(item *Item) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	if pool := x.pooled[item]; pool != nil {
+		pool.Touch(item)
+	}
+}
+
+// Repool - move item to the cache pool of its current storage handler,
+// returns false if the item is no longer indexed
+func (x *itemIndex) Repool(item *Item) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.items[item.Key] != item {
+		return false
+	}
+	if pool := x.pooled[item]; pool != nil {
+		pool.Remove(item)
+	}
+	pool := x.pool(item.Type, item.GetStorageType())
+	pool.Add(item)
+	x.pooled[item] = pool
+	return true
+}
+
+// Reschedule - schedule item to be checked for discard at its current
+// discard time, needed when its lifetime was shortened
+func (x *itemIndex) Reschedule(item *Item) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.items[item.Key] != item {
+		return
+	}
+	x.expiry.Schedule(item, item.DiscardTime())
+}
+
+// Expired - get items that can be discarded, items whose lifetime was
+// extended since they were scheduled are rescheduled
+func (x *itemIndex) Expired(now time.Time) []*Item {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	items := make([]*Item, 0)
+	for _, item := range x.expiry.Due(now) {
+		discardTime := item.DiscardTime()
+		if discardTime.After(now) {
+			x.expiry.Schedule(item, discardTime)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// FindByURL - get all items, every variant both public and private,
+// cached for given url
+func (x *itemIndex) FindByURL(url string) []*Item {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	items := make([]*Item, 0, len(x.urls[url]))
+	for item := range x.urls[url] {
+		items = append(items, item)
+	}
+	return items
+}
+
+// FindByTags - get all items tagged with any of the given tags
+func (x *itemIndex) FindByTags(tags []string) []*Item {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	found := make(itemSet)
+	for _, tag := range tags {
+		for item := range x.tags[tag] {
+			found[item] = struct{}{}
+		}
+	}
+	items := make([]*Item, 0, len(found))
+	for item := range found {
+		items = append(items, item)
+	}
+	return items
+}
+
+// FindByHeader - get all items with an invalidate header value that
+// satisfies the given match function, the match function is only called
+// once per distinct header value
+func (x *itemIndex) FindByHeader(name string, match func(value string) bool) []*Item {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	found := make(itemSet)
+	for value, set := range x.headers[name] {
+		if !match(value) {
+			continue
+		}
+		for item := range set {
+			found[item] = struct{}{}
+		}
+	}
+	items := make([]*Item, 0, len(found))
+	for item := range found {
+		items = append(items, item)
+	}
+	return items
+}
+
+// List - get snapshot of all items in index
+func (x *itemIndex) List() []*Item {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	items := make([]*Item, 0, len(x.items))
+	for _, item := range x.items {
+		items = append(items, item)
+	}
+	return items
+}
+
+// Len - get number of items in index
+func (x *itemIndex) Len() int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.items)
+}
+
+// Reset - remove all items from index, returns removed items
+func (x *itemIndex) Reset() []*Item {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	items := make([]*Item, 0, len(x.items))
+	for _, item := range x.items {
+		items = append(items, item)
+	}
+	x.reset()
+	return items
+}
@@ -0,0 +1,133 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIndexItem - create cache item held in memory for index tests
+func testIndexItem(key string, url string, tags ...string) *Item {
+	storage := &MemoryStorage{}
+	storage.Init(key, nil)
+	return &Item{
+		Type:    CacheItemPublic,
+		Key:     key,
+		BaseKey: key,
+		URL:     url,
+		Tags:    tags,
+		Size:    1,
+		Created: time.Now(),
+		MaxAge:  60,
+		storage: storage,
+	}
+}
+
+func TestItemIndexAdd(t *testing.T) {
+	index := newItemIndex(map[string]string{})
+	first := testIndexItem("a", "/a", "news")
+	if item, replaced := index.Add(first); item != first || len(replaced) != 0 {
+		t.Fatal("expected item to be added")
+	}
+	// unexpired item with the same key is kept
+	second := testIndexItem("a", "/a")
+	if item, _ := index.Add(second); item != first {
+		t.Fatal("expected existing item to be kept")
+	}
+	// expired item with the same key is replaced
+	ageItem(first, -time.Hour)
+	if item, replaced := index.Add(second); item != second || len(replaced) != 1 || replaced[0] != first {
+		t.Fatal("expected expired item to be replaced")
+	}
+	if len(index.FindByTags([]string{"news"})) != 0 {
+		t.Fatal("expected replaced item to be removed from tag index")
+	}
+	if index.Remove(first) {
+		t.Fatal("expected replaced item not to be removed again")
+	}
+	if !index.Remove(second) || index.Len() != 0 || len(index.FindByURL("/a")) != 0 {
+		t.Fatal("expected item to be removed")
+	}
+}
+
+func TestItemIndexConcurrent(t *testing.T) {
+	index := newItemIndex(map[string]string{})
+	var wait sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("key-%d", i%20)
+				url := fmt.Sprintf("/%d", i%10)
+				item, _ := index.Add(testIndexItem(key, url, fmt.Sprintf("tag-%d", i%3)))
+				index.FindByURL(url)
+				index.FindByTags([]string{"tag-0", "tag-1"})
+				index.Len()
+				index.Touch(item)
+				index.Pool(CacheItemPublic, CacheStorageMemory).Size()
+				switch (worker + i) % 4 {
+				case 0:
+					{
+						index.Remove(item)
+						break
+					}
+				case 1:
+					{
+						ageItem(item, -time.Hour)
+						index.Reschedule(item)
+						break
+					}
+				case 2:
+					{
+						index.Repool(item)
+						break
+					}
+				case 3:
+					{
+						for _, expired := range index.Expired(time.Now()) {
+							index.Remove(expired)
+						}
+						break
+					}
+				}
+			}
+		}(worker)
+	}
+	wait.Wait()
+	// secondary indexes agree with the items left
+	for _, item := range index.List() {
+		found := false
+		for _, urlItem := range index.FindByURL(item.URL) {
+			found = found || urlItem == item
+		}
+		if !found {
+			t.Fatalf("item '%s' missing from url index", item.Key)
+		}
+		index.Remove(item)
+	}
+	if index.Len() != 0 || len(index.urls) != 0 || len(index.tags) != 0 || len(index.variants) != 0 || len(index.pooled) != 0 {
+		t.Fatal("expected empty indexes once all items are removed")
+	}
+	if size := index.Pool(CacheItemPublic, CacheStorageMemory).Size(); size != 0 {
+		t.Fatalf("expected empty pool, got size %d", size)
+	}
+}
@@ -18,13 +18,20 @@ along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
 package ccache
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pquerna/cachecontrol/cacheobject"
@@ -38,17 +45,43 @@ const CacheItemPrivate = "private"
 
 // Item - cached item
 type Item struct {
-	Type              string
-	Key               string
-	Hits              int
-	Size              int64
-	Created           time.Time
-	LastHit           time.Time
-	MaxAge            int32
-	Path              string
-	InvalidateHeaders map[string][]string
-	EsiTags           []EsiTag
-	storage           Storage
+	Type                 string
+	Key                  string
+	BaseKey              string
+	Vary                 []string
+	Hits                 int
+	Size                 int64
+	Created              time.Time
+	LastHit              time.Time
+	MaxAge               int32
+	StaleWhileRevalidate int32
+	StaleIfError         int32
+	Keep                 int32
+	StatusCode           int
+	Header               http.Header
+	ContentLength        int64
+	Codec                string
+	Path                 string
+	URL                  string
+	RequestHeader        http.Header
+	InvalidateHeaders    map[string][]string
+	Tags                 []string
+	EsiTags              []EsiTag
+	StorageKey           string
+	storage              Storage
+	storageHits          int
+	cleared              bool
+	banSeq               uint64
+	mutex                sync.RWMutex
+	moveMutex            sync.Mutex
+}
+
+// itemLifetime - lifetimes, in seconds, to cache a response with
+type itemLifetime struct {
+	MaxAge               int32
+	StaleWhileRevalidate int32
+	StaleIfError         int32
+	Keep                 int32
 }
 
 // PublicKeyFromRequest - generate public cache key from request
@@ -89,12 +122,85 @@ func PrivateKeyFromRequest(r *http.Request, config *Config) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-// ItemFromResponse - create cache item from response
-func ItemFromResponse(resp *http.Response, config *Config) (Item, error) {
+// URLFromRequest - get url, path and sorted query, of the object a request
+// is for, all variants of an object share it
+func URLFromRequest(r *http.Request) string {
+	query := r.URL.Query().Encode()
+	if query == "" {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + query
+}
+
+// VaryFromResponse - get sorted, canonical names of the request headers
+// listed in the response's vary header, returns false if the response
+// varies on everything and so can't be cached
+func VaryFromResponse(resp *http.Response) ([]string, bool) {
+	names := make([]string, 0)
+	seen := map[string]bool{}
+	for _, value := range resp.Header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			name = http.CanonicalHeaderKey(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// VariantKeyFromRequest - generate cache key for the variant of a response
+// selected by the request's values of the given vary headers
+func VariantKeyFromRequest(baseKey string, r *http.Request, varyHeaders []string) string {
+	if len(varyHeaders) == 0 {
+		return baseKey
+	}
+	h := md5.New()
+	io.WriteString(h, baseKey)
+	for _, headerName := range varyHeaders {
+		values := make([]string, 0)
+		for _, headerValue := range r.Header[headerName] {
+			for _, value := range strings.Split(headerValue, ",") {
+				values = append(values, strings.TrimSpace(value))
+			}
+		}
+		io.WriteString(h, headerName)
+		io.WriteString(h, ":")
+		io.WriteString(h, strings.Join(values, ","))
+		io.WriteString(h, "\n")
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// ItemFromResponse - create cache item from response and store its body
+func ItemFromResponse(resp *http.Response, config *Config) (*Item, error) {
+	item, err := newItemFromResponse(resp, config)
+	if err != nil || item == nil {
+		return item, err
+	}
+	// store response body, headers are kept with the item
+	defer resp.Body.Close()
+	contentLength, err := item.storeBody(resp.Body)
+	if err != nil {
+		return item, err
+	}
+	return item, item.setStored(contentLength)
+}
+
+// newItemFromResponse - create cache item from response, the response
+// body is not yet stored
+func newItemFromResponse(resp *http.Response, config *Config) (*Item, error) {
 	// parse cache control header
 	cacheControl, err := cacheobject.ParseResponseCacheControl(resp.Header.Get("Cache-Control"))
 	if err != nil {
-		return Item{}, err
+		return nil, err
 	}
 	// determine cache item type
 	itemType := CacheItemPublic
@@ -116,9 +222,16 @@ func ItemFromResponse(resp *http.Response, config *Config) (Item, error) {
 		}
 	default:
 		{
-			return Item{}, nil
+			return nil, nil
 		}
 	}
+	// each variant of a response gets its own key
+	vary, ok := VaryFromResponse(resp)
+	if !ok {
+		return nil, nil
+	}
+	baseKey := key
+	key = VariantKeyFromRequest(baseKey, resp.Request, vary)
 	// set custom vars (used for BAN/PURGE)
 	invalidateHeaders := map[string][]string{}
 	for _, headerName := range config.InvalidateHeaders {
@@ -126,59 +239,310 @@ func ItemFromResponse(resp *http.Response, config *Config) (Item, error) {
 	}
 	// get cache storage handler
 	if len(config.CacheStorageHandlers) == 0 {
-		return Item{}, errors.New("no storage handler provided")
+		return nil, errors.New("no storage handler provided")
 	}
 	storage := GetStorageHandler(config.CacheStorageHandlers[0])
 	if storage == nil {
-		return Item{}, fmt.Errorf("could not find storage handler '%s'", config.CacheStorageHandlers[0])
+		return nil, fmt.Errorf("could not find storage handler '%s'", config.CacheStorageHandlers[0])
 	}
 	// create cache item struct
-	item := Item{
+	item := &Item{
 		Type:              itemType,
 		Key:               key,
+		BaseKey:           baseKey,
+		Vary:              vary,
 		Path:              resp.Request.URL.Path,
+		URL:               URLFromRequest(resp.Request),
+		RequestHeader:     copyRequestHeader(resp.Request.Header),
 		Hits:              0,
 		Size:              0,
 		Created:           time.Now(),
 		InvalidateHeaders: invalidateHeaders,
+		Tags:              TagsFromHeader(resp.Header, config.TagHeaders),
+		StorageKey:        newStorageKey(key),
 		storage:           storage,
 	}
 	// log
 	item.LogAction("create", "-")
-	// init storage
-	item.storage.Init(key, config)
-	// parse esi
-	resp, esiTags, err := ParseESI(resp)
+	// init storage, each item gets its own storage key so that a replaced
+	// item can be cleared without touching the storage of its replacement
+	item.storage.Init(item.StorageKey, config)
+	// parse esi, only textual responses can contain esi tags, the body
+	// has to be read in full to do so
+	if config.UseESI && IsESIContentType(resp.Header.Get("Content-Type")) {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(config.ResponseMaxSize)+1))
+		if err != nil {
+			return item, err
+		}
+		if len(body) > config.ResponseMaxSize {
+			item.LogAction("invalidate", "REASON = response too large")
+			resp.Body = &storageReader{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), closers: []io.Closer{resp.Body}}
+			return nil, nil
+		}
+		resp.Body.Close()
+		setResponseBody(resp, body)
+		var esiTags []EsiTag
+		resp, esiTags, err = ParseESI(resp)
+		if err != nil {
+			return item, err
+		}
+		item.EsiTags = esiTags
+	}
+	item.StatusCode = resp.StatusCode
+	item.Header = copyHeader(resp.Header)
+	item.Codec = storageCodec(item.Header, config, item.storage.GetTypeName())
+	return item, nil
+}
+
+// storeBody - encode response body with the codec of this cache item and
+// write it to storage, returns the number of body bytes stored
+func (i *Item) storeBody(body io.Reader) (int64, error) {
+	i.mutex.RLock()
+	i.expireStorageLocked(i.storage)
+	i.mutex.RUnlock()
+	return encodeBody(i.storage, i.Codec, body)
+}
+
+// expireStorageLocked - let storage handlers that expire stored responses
+// by themselves keep this cache item until it can be discarded, must hold lock
+func (i *Item) expireStorageLocked(storage Storage) {
+	expiringStorage, ok := storage.(ExpiringStorage)
+	if !ok {
+		return
+	}
+	ttl := time.Until(i.discardTimeLocked())
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	if err := expiringStorage.SetExpiry(ttl); err != nil {
+		i.LogAction("expire", "ERROR = "+err.Error())
+	}
+}
+
+// encodeBody - encode response body with given codec and write it to
+// storage, returns the number of body bytes stored
+func encodeBody(storage Storage, codecSpec string, body io.Reader) (int64, error) {
+	codec, err := GetCodec(codecSpec)
 	if err != nil {
-		return item, err
+		return 0, err
 	}
-	item.EsiTags = esiTags
-	// store response
-	err = item.storage.StoreResponse(resp)
+	if codec.GetName() == CodecNone {
+		return storage.Store(body)
+	}
+	// encoder writes in to a pipe that is read by storage
+	pr, pw := io.Pipe()
+	written := make(chan int64, 1)
+	go func() {
+		w, err := codec.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			written <- 0
+			return
+		}
+		n, err := io.Copy(w, body)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+		written <- n
+	}()
+	_, err = storage.Store(pr)
+	pr.CloseWithError(err)
+	return <-written, err
+}
+
+// fetchBody - open stream of decoded response body from storage, must hold lock
+func (i *Item) fetchBody() (io.ReadCloser, error) {
+	return decodeBody(i.storage, i.Codec)
+}
+
+// decodeBody - open stream of response body from storage decoded with given codec
+func decodeBody(storage Storage, codecSpec string) (io.ReadCloser, error) {
+	codec, err := GetCodec(codecSpec)
 	if err != nil {
-		return item, err
+		return nil, err
+	}
+	body, err := storage.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	r, err := codec.NewReader(bufio.NewReader(body))
+	if err != nil {
+		body.Close()
+		return nil, err
 	}
+	return &storageReader{Reader: r, closers: []io.Closer{r, body}}, nil
+}
+
+// setStored - record that the response body of this cache item was
+// stored and persist its metadata
+func (i *Item) setStored(contentLength int64) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.ContentLength = contentLength
 	// get size of response in storage
-	item.Size, err = item.storage.GetSize()
-	return item, err
+	size, err := i.storage.GetSize()
+	if err != nil {
+		return err
+	}
+	i.Size = size
+	return i.persistLocked()
 }
 
-// GetResponse - convert cache item in to http response
+// GetResponse - convert cache item in to http response, the body is
+// streamed from storage
 func (i *Item) GetResponse() (*http.Response, error) {
-	resp, err := i.storage.FetchResponse()
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	body, err := i.fetchBody()
 	if err != nil {
 		return nil, err
 	}
+	resp := i.newResponse(body, i.ContentLength)
+	if contentCoding(i.Codec) != "" {
+		addVary(resp.Header, "Accept-Encoding")
+	}
 	return resp, nil
 }
 
+// GetEncodedResponse - convert cache item in to http response, the body is
+// sent as stored if the request accepts the content coding it was stored
+// with, otherwise it is decoded
+func (i *Item) GetEncodedResponse(r *http.Request) (*http.Response, error) {
+	i.mutex.RLock()
+	coding := contentCoding(i.Codec)
+	if coding == "" || !acceptsEncoding(r.Header.Get("Accept-Encoding"), coding) {
+		i.mutex.RUnlock()
+		return i.GetResponse()
+	}
+	defer i.mutex.RUnlock()
+	body, err := i.storage.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	resp := i.newResponse(body, i.Size)
+	resp.Header.Set("Content-Encoding", coding)
+	addVary(resp.Header, "Accept-Encoding")
+	// encoded body is a different representation, strong etags must not match
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return resp, nil
+}
+
+// newResponse - create http response with stored status and headers and
+// given body, must hold lock
+func (i *Item) newResponse(body io.ReadCloser, contentLength int64) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.StatusCode, http.StatusText(i.StatusCode)),
+		StatusCode:    i.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        copyHeader(i.Header),
+		Body:          body,
+		ContentLength: contentLength,
+	}
+	resp.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	return resp
+}
+
+// GetHeader - get stored response header value
+func (i *Item) GetHeader(name string) string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.Header.Get(name)
+}
+
+// MergedHeader - get copy of stored response headers updated with the
+// given headers
+func (i *Item) MergedHeader(header http.Header) http.Header {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	merged := copyHeader(i.Header)
+	for name, values := range copyHeader(header) {
+		merged[name] = values
+	}
+	return merged
+}
+
+// Refresh - replace stored response headers and lifetime, resetting the
+// age of this cache item
+func (i *Item) Refresh(header http.Header, lifetime itemLifetime) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.Header = header
+	i.Created = time.Now()
+	i.setLifetimeLocked(lifetime)
+	i.expireStorageLocked(i.storage)
+	if err := i.persistLocked(); err != nil {
+		i.LogAction("persist", "ERROR = "+err.Error())
+	}
+}
+
+// Expire - expire this cache item now by lowering its max age to its
+// current age, it can still be revalidated for as long as its lifetimes
+// allow and be served stale for at least the grace given unless it must
+// revalidate, returns false if it had already expired
+func (i *Item) Expire(grace int32) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if !i.isWithin(0) {
+		return false
+	}
+	i.MaxAge = int32(time.Since(i.Created) / time.Second)
+	if i.StaleWhileRevalidate < grace && !i.mustRevalidateLocked() {
+		i.StaleWhileRevalidate = grace
+	}
+	i.expireStorageLocked(i.storage)
+	if err := i.persistLocked(); err != nil {
+		i.LogAction("persist", "ERROR = "+err.Error())
+	}
+	return true
+}
+
+// mustRevalidateLocked - check if this cache item must not be served
+// stale once expired, must hold lock
+func (i *Item) mustRevalidateLocked() bool {
+	cacheControl, err := cacheobject.ParseResponseCacheControl(i.Header.Get("Cache-Control"))
+	if err != nil {
+		return true
+	}
+	return cacheControl.MustRevalidate || cacheControl.ProxyRevalidate
+}
+
+// setLifetime - set lifetimes of this cache item
+func (i *Item) setLifetime(lifetime itemLifetime) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.setLifetimeLocked(lifetime)
+}
+
+// setLifetimeLocked - set lifetimes of this cache item, must hold lock
+func (i *Item) setLifetimeLocked(lifetime itemLifetime) {
+	i.MaxAge = lifetime.MaxAge
+	i.StaleWhileRevalidate = lifetime.StaleWhileRevalidate
+	i.StaleIfError = lifetime.StaleIfError
+	i.Keep = lifetime.Keep
+}
+
 // GetStorageType - get storage type name
 func (i *Item) GetStorageType() string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
 	return i.storage.GetTypeName()
 }
 
-// MoveStorage - convert current storage to given new storage
+// MoveStorage - convert current storage to given new storage, the
+// response body is copied without holding the lock so the item can still
+// be served, nothing is moved if the item was cleared meanwhile
 func (i *Item) MoveStorage(name string, config *Config) error {
+	// one move at a time, storage handlers share the item's storage key
+	i.moveMutex.Lock()
+	defer i.moveMutex.Unlock()
+	if i.GetStorageType() == name {
+		return nil
+	}
 	// log action
 	i.LogAction("move", fmt.Sprintf("Move storage to '%s'", name))
 	// init new storage
@@ -186,41 +550,194 @@ func (i *Item) MoveStorage(name string, config *Config) error {
 	if newStorage == nil {
 		return fmt.Errorf("could not find storage handler '%s'", name)
 	}
-	newStorage.Init(i.Key, config)
-	// fetch response from old storage
-	resp, err := i.storage.FetchResponse()
-	if err != nil {
-		return err
+	newStorage.Init(i.StorageKey, config)
+	i.mutex.RLock()
+	oldStorage := i.storage
+	oldCodec := i.Codec
+	codecSpec := storageCodec(i.Header, config, name)
+	i.expireStorageLocked(newStorage)
+	i.mutex.RUnlock()
+	// stream response body from old storage in to new storage, the body
+	// is only re-encoded if the new storage uses a different codec
+	if sameCodec(codecSpec, oldCodec) {
+		body, err := oldStorage.Fetch()
+		if err != nil {
+			return err
+		}
+		_, err = newStorage.Store(body)
+		body.Close()
+		if err != nil {
+			newStorage.Delete()
+			return err
+		}
+		codecSpec = oldCodec
+	} else {
+		body, err := decodeBody(oldStorage, oldCodec)
+		if err != nil {
+			return err
+		}
+		_, err = encodeBody(newStorage, codecSpec, body)
+		body.Close()
+		if err != nil {
+			newStorage.Delete()
+			return err
+		}
 	}
-	// store response in new storage
-	err = newStorage.StoreResponse(resp)
+	size, err := newStorage.GetSize()
 	if err != nil {
+		newStorage.Delete()
 		return err
 	}
-	// clear old storage
-	err = i.storage.Delete()
+	// swap storage
+	i.mutex.Lock()
+	if i.cleared {
+		i.mutex.Unlock()
+		newStorage.Delete()
+		i.LogAction("move", "REASON = cleared while moving")
+		return nil
+	}
+	i.storage = newStorage
+	i.Codec = codecSpec
+	i.storageHits = 0
+	i.Size = size
+	data, err := json.Marshal(i)
+	i.mutex.Unlock()
+	// clear old storage, readers that already opened it keep reading
+	oldStorage.Delete()
 	if err != nil {
 		return err
 	}
-	i.storage = newStorage
-	return nil
+	// persist metadata, unless the item was cleared while doing so
+	if metaStorage, ok := newStorage.(MetaStorage); ok {
+		err = metaStorage.StoreMeta(data)
+		i.mutex.RLock()
+		cleared := i.cleared
+		i.mutex.RUnlock()
+		if cleared {
+			newStorage.Delete()
+		}
+	}
+	return err
+}
+
+// Hit - record a cache hit, returns the new hit count
+func (i *Item) Hit() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.Hits++
+	i.storageHits++
+	i.LastHit = time.Now()
+	return i.Hits
+}
+
+// GetStorageHits - get number of cache hits since the item was moved to
+// its current storage handler
+func (i *Item) GetStorageHits() int {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.storageHits
+}
+
+// GetLastHit - get time of last cache hit
+func (i *Item) GetLastHit() time.Time {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.LastHit
+}
+
+// GetSize - get size of cache item in storage
+func (i *Item) GetSize() int64 {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.Size
+}
+
+// Age - get age of cache item in seconds
+func (i *Item) Age() int {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return int(time.Since(i.Created) / time.Second)
+}
+
+// getExpireTime - get time at which this cache item expires, must hold lock
+func (i *Item) getExpireTime() time.Time {
+	return i.Created.Add(time.Duration(i.MaxAge) * time.Second)
+}
+
+// isWithin - check if given number of seconds past expiry has not yet
+// elapsed, must hold lock
+func (i *Item) isWithin(seconds int32) bool {
+	return time.Now().Before(i.getExpireTime().Add(time.Duration(seconds) * time.Second))
 }
 
 // HasExpired - check if this cache item has expired
 func (i *Item) HasExpired() bool {
-	// check max age
-	now := time.Now()
-	expireTime := i.Created.Add(time.Duration(i.MaxAge) * time.Second)
-	if !now.Before(expireTime) {
-		return true
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return !i.isWithin(0)
+}
+
+// CanServeStale - check if this cache item has expired but is still within
+// its stale-while-revalidate window
+func (i *Item) CanServeStale() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return !i.isWithin(0) && i.isWithin(i.StaleWhileRevalidate)
+}
+
+// CanServeStaleOnError - check if this cache item has expired but is still
+// within its stale-if-error window
+func (i *Item) CanServeStaleOnError() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return !i.isWithin(0) && i.isWithin(i.StaleIfError)
+}
+
+// CanRevalidate - check if this cache item has expired but can still be
+// revalidated with upstream using a conditional request
+func (i *Item) CanRevalidate() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.Header.Get("ETag") == "" && i.Header.Get("Last-Modified") == "" {
+		return false
 	}
-	return false
+	return !i.isWithin(0) && i.isWithin(i.Keep)
+}
+
+// DiscardTime - get time after which this cache item can no longer be
+// served stale or revalidated
+func (i *Item) DiscardTime() time.Time {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.discardTimeLocked()
+}
+
+// discardTimeLocked - get time after which this cache item can no longer
+// be served, must hold lock
+func (i *Item) discardTimeLocked() time.Time {
+	grace := i.StaleWhileRevalidate
+	if i.StaleIfError > grace {
+		grace = i.StaleIfError
+	}
+	if i.Keep > grace && (i.Header.Get("ETag") != "" || i.Header.Get("Last-Modified") != "") {
+		grace = i.Keep
+	}
+	return i.getExpireTime().Add(time.Duration(grace) * time.Second)
+}
+
+// CanDiscard - check if this cache item has expired and can no longer be
+// served stale or revalidated
+func (i *Item) CanDiscard() bool {
+	return !time.Now().Before(i.DiscardTime())
 }
 
 // Clear - delete this cache item
 func (i *Item) Clear() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
 	i.storage.Delete()
 	i.Size = 0
+	i.cleared = true
 }
 
 // LogAction - log action taken against cache item
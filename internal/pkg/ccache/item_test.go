@@ -0,0 +1,112 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// testStoredItem - store response in memory and get its cache item
+func testStoredItem(t *testing.T, handler *Handler, url string, body string) *Item {
+	item, err := handler.Store(testResp(testReq("GET", url), 200, "max-age=60", body, nil))
+	if err != nil || item == nil {
+		t.Fatalf("response not stored, %v", err)
+	}
+	return item
+}
+
+// testCacheFiles - count files in the file cache directory
+func testCacheFiles(t *testing.T, config Config) int {
+	files, err := ioutil.ReadDir(config.CacheFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestMoveStorage(t *testing.T) {
+	config := testConfig(t)
+	handler := testHandler(t, config)
+	item := testStoredItem(t, handler, "http://cache.test/move", "body")
+	// response opened before the move can still be read after it
+	resp, err := item.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := item.MoveStorage(CacheStorageFile, &handler.Config); err != nil {
+		t.Fatal(err)
+	}
+	if readBody(t, resp) != "body" {
+		t.Fatal("response opened before move not readable")
+	}
+	if item.GetStorageType() != CacheStorageFile || item.GetStorageHits() != 0 {
+		t.Fatalf("item not moved, storage '%s'", item.GetStorageType())
+	}
+	resp, err = item.GetResponse()
+	if err != nil || readBody(t, resp) != "body" {
+		t.Fatalf("moved item not readable, %v", err)
+	}
+}
+
+func TestMoveStorageCleared(t *testing.T) {
+	config := testConfig(t)
+	handler := testHandler(t, config)
+	item := testStoredItem(t, handler, "http://cache.test/move", "body")
+	handler.removeItem(item)
+	// cleared item is not moved and leaves nothing in the new storage
+	if err := item.MoveStorage(CacheStorageFile, &handler.Config); err != nil {
+		t.Fatal(err)
+	}
+	if item.GetStorageType() != CacheStorageMemory {
+		t.Fatal("cleared item moved")
+	}
+	if count := testCacheFiles(t, config); count != 0 {
+		t.Fatalf("expected no cache files, got %d", count)
+	}
+}
+
+func TestMoveStorageConcurrent(t *testing.T) {
+	config := testConfig(t)
+	handler := testHandler(t, config)
+	item := testStoredItem(t, handler, "http://cache.test/move", "body")
+	// only one of the moves takes effect, the other leaves no copy behind
+	var wg sync.WaitGroup
+	for worker := 0; worker < 2; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := item.MoveStorage(CacheStorageFile, &handler.Config); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if item.GetStorageType() != CacheStorageFile {
+		t.Fatal("item not moved")
+	}
+	resp, err := item.GetResponse()
+	if err != nil || readBody(t, resp) != "body" {
+		t.Fatalf("moved item not readable, %v", err)
+	}
+	handler.removeItem(item)
+	if count := testCacheFiles(t, config); count != 0 {
+		t.Fatalf("expected no cache files, got %d", count)
+	}
+}
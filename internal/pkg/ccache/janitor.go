@@ -0,0 +1,200 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"log"
+	"time"
+)
+
+// janitorInterval - how often the janitor discards expired cache items
+const janitorInterval = time.Second
+
+// startJanitor - start background maintenance of the cache
+func (b *Handler) startJanitor() {
+	b.janitorStop = make(chan struct{})
+	b.janitorDone = make(chan struct{})
+	b.janitorWake = make(chan struct{}, 1)
+	go b.runJanitor()
+}
+
+// stopJanitor - stop background maintenance and wait for it to finish
+func (b *Handler) stopJanitor() {
+	b.janitorOnce.Do(func() {
+		close(b.janitorStop)
+		<-b.janitorDone
+	})
+}
+
+// wakeJanitor - ask the janitor to enforce cache pool sizes
+func (b *Handler) wakeJanitor() {
+	select {
+	case b.janitorWake <- struct{}{}:
+	default:
+	}
+}
+
+// runJanitor - background maintenance loop, expired items are discarded
+// every janitor interval, pool sizes are enforced whenever a pool goes
+// over budget, a full clean runs every clean interval and the ban lurker
+// runs every ban lurker interval
+func (b *Handler) runJanitor() {
+	defer close(b.janitorDone)
+	cleanInterval := time.Duration(b.Config.CleanInterval) * time.Second
+	if cleanInterval < janitorInterval {
+		cleanInterval = janitorInterval
+	}
+	expireTicker := time.NewTicker(janitorInterval)
+	defer expireTicker.Stop()
+	cleanTicker := time.NewTicker(cleanInterval)
+	defer cleanTicker.Stop()
+	lurkerInterval := time.Duration(b.Config.BanLurkerInterval) * time.Second
+	if lurkerInterval < janitorInterval {
+		lurkerInterval = janitorInterval
+	}
+	lurkerTicker := time.NewTicker(lurkerInterval)
+	defer lurkerTicker.Stop()
+	for {
+		select {
+		case <-b.janitorStop:
+			{
+				return
+			}
+		case <-b.janitorWake:
+			{
+				b.enforceSize()
+				break
+			}
+		case <-expireTicker.C:
+			{
+				b.expireItems()
+				break
+			}
+		case <-cleanTicker.C:
+			{
+				b.Clean()
+				break
+			}
+		case <-lurkerTicker.C:
+			{
+				b.lurkBans()
+				break
+			}
+		}
+	}
+}
+
+// checkPoolSize - wake the janitor if the cache pool holding item is over budget
+func (b *Handler) checkPoolSize(item *Item) {
+	storageName := item.GetStorageType()
+	pool := b.items.Pool(item.Type, storageName)
+	if pool.Size() > int64(b.Config.CacheMaxSize[item.Type][storageName]) {
+		b.wakeJanitor()
+	}
+}
+
+// expireItems - remove cache items that can no longer be served
+func (b *Handler) expireItems() {
+	b.cleanMutex.Lock()
+	defer b.cleanMutex.Unlock()
+	for _, item := range b.items.Expired(time.Now()) {
+		item.LogAction("invalidate", "REASON = max age expired")
+		b.removeItem(item)
+	}
+}
+
+// lurkBans - test every cache item against the bans issued since it was
+// last tested, once all items are tested the bans can be retired
+func (b *Handler) lurkBans() {
+	if b.bans.Len() == 0 {
+		return
+	}
+	head := b.bans.Head()
+	for _, item := range b.items.List() {
+		b.checkBans(item)
+	}
+	if count := b.bans.Retire(head); count > 0 {
+		log.Printf("CACHE :: BAN LURKER :: RETIRED = %d", count)
+	}
+}
+
+// enforceSize - evict items from cache pools that are over budget, items
+// are moved to the next storage handler or removed from the last one
+func (b *Handler) enforceSize() {
+	b.cleanMutex.Lock()
+	defer b.cleanMutex.Unlock()
+	// split cache storage in to different pools for each cache type (public/private)
+	// and for each storage handler (memory/file)
+	cacheTypes := []string{CacheItemPublic, CacheItemPrivate}
+	for _, cacheType := range cacheTypes {
+		for storageIndex, cacheStorageHandler := range b.Config.CacheStorageHandlers {
+			pool := b.items.Pool(cacheType, cacheStorageHandler)
+			// pool reached max size, evict items chosen by the pool's eviction policy
+			for pool.Size() > int64(b.Config.CacheMaxSize[cacheType][cacheStorageHandler]) {
+				victim := pool.Victim()
+				if victim == nil {
+					break
+				}
+				// delete if last storage handler
+				if storageIndex+1 >= len(b.Config.CacheStorageHandlers) {
+					victim.LogAction("invalidate", "REASON = evicted")
+					b.removeItem(victim)
+					continue
+				}
+				// delete if it would expire too soon to be worth moving to
+				// the next storage handler
+				nextStorageHandler := b.Config.CacheStorageHandlers[storageIndex+1]
+				minTTL := time.Duration(b.Config.StorageMinTTL[nextStorageHandler]) * time.Second
+				if time.Until(victim.DiscardTime()) < minTTL {
+					victim.LogAction("invalidate", "REASON = evicted, expires too soon to move to '"+nextStorageHandler+"'")
+					b.removeItem(victim)
+					continue
+				}
+				// move to next storage handler
+				err := victim.MoveStorage(nextStorageHandler, &b.Config)
+				if err != nil {
+					victim.LogAction("move", "ERROR = "+err.Error())
+					b.removeItem(victim)
+					continue
+				}
+				// item was removed while it was being moved
+				if !b.items.Repool(victim) {
+					victim.Clear()
+				}
+			}
+		}
+	}
+}
+
+// Clean - full clean up of cache items, catches anything the incremental
+// expiry missed
+func (b *Handler) Clean() {
+	log.Println("CACHE :: CLEAN")
+	b.collapser.Clean()
+	b.redisMisses.Clean()
+	// clear expired
+	b.cleanMutex.Lock()
+	for _, item := range b.items.List() {
+		if item.CanDiscard() {
+			item.LogAction("invalidate", "REASON = max age expired")
+			b.removeItem(item)
+		}
+	}
+	b.cleanMutex.Unlock()
+	b.enforceSize()
+}
@@ -0,0 +1,137 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// Persist - persist cache item metadata if its storage handler supports it
+func (i *Item) Persist() error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.persistLocked()
+}
+
+// persistLocked - persist cache item metadata, must hold lock
+func (i *Item) persistLocked() error {
+	metaStorage, ok := i.storage.(MetaStorage)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return metaStorage.StoreMeta(data)
+}
+
+// loadItem - load cache item from metadata file
+func loadItem(metaFileName string, storageKey string, config *Config) (*Item, error) {
+	data, err := ioutil.ReadFile(metaFileName)
+	if err != nil {
+		return nil, err
+	}
+	storage := &FileStorage{}
+	storage.Init(storageKey, config)
+	return itemFromMeta(data, storageKey, storage)
+}
+
+// itemFromMeta - create cache item from its metadata and the storage
+// handler holding its response
+func itemFromMeta(data []byte, storageKey string, storage Storage) (*Item, error) {
+	item := &Item{}
+	err := json.Unmarshal(data, item)
+	if err != nil {
+		return nil, err
+	}
+	// metadata without a status code predates headers being stored
+	// apart from the response body
+	if item.Key == "" || item.StorageKey != storageKey || item.StatusCode == 0 {
+		return nil, errors.New("invalid metadata")
+	}
+	// response bodies stored before codecs were configurable are gzipped
+	if item.Codec == "" {
+		item.Codec = CodecGzip
+	}
+	// metadata stored before urls were indexed only has the path
+	if item.URL == "" {
+		item.URL = item.Path
+	}
+	// stored response must be intact
+	size, err := storage.GetSize()
+	if err != nil {
+		return nil, err
+	}
+	if size != item.Size {
+		return nil, fmt.Errorf("size mismatch, expected %d got %d", item.Size, size)
+	}
+	item.storage = storage
+	return item, nil
+}
+
+// LoadItems - load cache items persisted in the file system cache,
+// expired or corrupted entries are removed
+func LoadItems(config *Config) []*Item {
+	items := make([]*Item, 0)
+	cacheFilePath := strings.TrimRight(config.CacheFilePath, "/") + "/"
+	files, err := ioutil.ReadDir(cacheFilePath)
+	if err != nil {
+		return items
+	}
+	loaded := map[string]bool{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), CacheItemMetaFileExtension) {
+			continue
+		}
+		storageKey := strings.TrimSuffix(file.Name(), CacheItemMetaFileExtension)
+		item, err := loadItem(cacheFilePath+file.Name(), storageKey, config)
+		if err != nil {
+			log.Printf("CACHE :: LOAD :: %s :: ERROR = %s", storageKey, err.Error())
+			os.Remove(cacheFilePath + storageKey + CacheItemFileExtension)
+			os.Remove(cacheFilePath + file.Name())
+			continue
+		}
+		if item.CanDiscard() {
+			item.LogAction("invalidate", "REASON = max age expired")
+			item.Clear()
+			continue
+		}
+		item.LogAction("load", "-")
+		loaded[storageKey] = true
+		items = append(items, item)
+	}
+	// remove stored responses without metadata and any other leftovers
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		storageKey := strings.TrimSuffix(file.Name(), CacheItemFileExtension)
+		storageKey = strings.TrimSuffix(storageKey, CacheItemMetaFileExtension)
+		if !loaded[storageKey] {
+			os.Remove(cacheFilePath + file.Name())
+		}
+	}
+	return items
+}
@@ -0,0 +1,47 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"testing"
+)
+
+func TestWarmStart(t *testing.T) {
+	config := testConfig(t)
+	if config.WarmStart {
+		t.Fatal("expected warm start to be opt in")
+	}
+	config.WarmStart = true
+	handler := testHandler(t, config)
+	handler.Store(testResp(testReq("GET", "http://cache.test/warm"), 200, "max-age=60", "warm", map[string]string{
+		"ETag": `"v1"`,
+	}))
+	handler.Close()
+	// memory cache is persisted to the file system and loaded on start
+	handler = testHandler(t, config)
+	resp, _ := handler.OnRequest(testReq("GET", "http://cache.test/warm"))
+	if resp == nil || readBody(t, resp) != "warm" || resp.Header.Get("ETag") != `"v1"` {
+		t.Fatal("expected persisted item to be loaded")
+	}
+	handler.Close()
+	// cold start clears the file system cache
+	config.WarmStart = false
+	if testHandler(t, config).items.Len() != 0 || testCacheFiles(t, config) != 0 {
+		t.Fatal("expected cache to be cleared on cold start")
+	}
+}
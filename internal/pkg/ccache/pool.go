@@ -0,0 +1,94 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"sync"
+)
+
+// cachePool - cache items of one cache type (public/private) held by one
+// storage handler (memory/file), the order in which items are evicted is
+// decided by the pool's eviction policy
+type cachePool struct {
+	mutex  sync.Mutex
+	size   int64
+	sizes  map[*Item]int64
+	policy EvictionPolicy
+}
+
+// newCachePool - create new empty cache pool using given eviction policy
+func newCachePool(policy EvictionPolicy) *cachePool {
+	return &cachePool{
+		sizes:  make(map[*Item]int64),
+		policy: policy,
+	}
+}
+
+// poolName - get name of pool for given cache type and storage handler
+func poolName(cacheType string, storageName string) string {
+	return cacheType + "/" + storageName
+}
+
+// Add - add item to pool
+func (p *cachePool) Add(item *Item) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.sizes[item]; ok {
+		return
+	}
+	size := item.GetSize()
+	p.sizes[item] = size
+	p.size += size
+	p.policy.Add(item, size)
+}
+
+// Touch - record a hit on item
+func (p *cachePool) Touch(item *Item) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.sizes[item]; ok {
+		p.policy.Touch(item)
+	}
+}
+
+// Remove - remove item from pool
+func (p *cachePool) Remove(item *Item) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	size, ok := p.sizes[item]
+	if !ok {
+		return
+	}
+	p.policy.Remove(item)
+	delete(p.sizes, item)
+	p.size -= size
+}
+
+// Victim - get item to evict next
+func (p *cachePool) Victim() *Item {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.policy.Victim()
+}
+
+// Size - get total size of items in pool
+func (p *cachePool) Size() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
@@ -0,0 +1,318 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errRangeNotSatisfiable - none of the requested byte ranges overlap the response body
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// rangeContextKey - request context key of the byte range headers held
+// back from the upstream request of a cache miss
+type rangeContextKey struct{}
+
+// heldRange - byte range headers of a client request
+type heldRange struct {
+	rangeHeader   string
+	ifRangeHeader string
+}
+
+// byteRange - byte range of a response body
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// contentRange - get content-range header value for byte range
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange - parse range header value in to byte ranges of a body with given size
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errors.New("invalid range unit")
+	}
+	ranges := make([]byteRange, 0)
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return nil, errors.New("invalid range")
+		}
+		startSpec := strings.TrimSpace(spec[:dash])
+		endSpec := strings.TrimSpace(spec[dash+1:])
+		var r byteRange
+		if startSpec == "" {
+			// suffix range, last n bytes
+			suffix, err := strconv.ParseInt(endSpec, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if suffix == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			r.start = size - suffix
+			r.length = suffix
+		} else {
+			start, err := strconv.ParseInt(startSpec, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			// range starts past end of body, ignored unless no range is satisfiable
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if endSpec != "" {
+				end, err = strconv.ParseInt(endSpec, 10, 64)
+				if err != nil || end < start {
+					return nil, errors.New("invalid range")
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r.start = start
+			r.length = end - start + 1
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// ifRangeMatch - check if the if-range request header matches the response
+func ifRangeMatch(req *http.Request, resp *http.Response) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	// entity tag, must be a strong match
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := resp.Header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	// date, must exactly match last modified
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return lastModified.Equal(since)
+}
+
+// holdRange - remove byte range headers from a request that missed the
+// cache so upstream sends the full response to store, the headers are kept
+// in the request context and put back by restoreRange
+func holdRange(req *http.Request) {
+	rangeHeader := req.Header.Get("Range")
+	if req.Method != http.MethodGet || rangeHeader == "" {
+		return
+	}
+	held := heldRange{
+		rangeHeader:   rangeHeader,
+		ifRangeHeader: req.Header.Get("If-Range"),
+	}
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	// request is passed on by pointer, update it in place
+	*req = *req.WithContext(context.WithValue(req.Context(), rangeContextKey{}, held))
+}
+
+// restoreRange - put byte range headers held back by holdRange back on
+// the request so the response can be sliced for the client
+func restoreRange(req *http.Request) {
+	held, ok := req.Context().Value(rangeContextKey{}).(heldRange)
+	if !ok || req.Header.Get("Range") != "" {
+		return
+	}
+	req.Header.Set("Range", held.rangeHeader)
+	if held.ifRangeHeader != "" {
+		req.Header.Set("If-Range", held.ifRangeHeader)
+	}
+}
+
+// setResponseBody - replace body of response
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// ServeRange - convert full cached response in to a partial content
+// response if the request asks for a byte range, a single range is
+// streamed from the response body, only the parts of multiple ranges are
+// buffered
+func ServeRange(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	resp.Header.Set("Accept-Ranges", "bytes")
+	rangeHeader := req.Header.Get("Range")
+	if req.Method != http.MethodGet || rangeHeader == "" || !ifRangeMatch(req, resp) {
+		return resp, nil
+	}
+	// size has to be known to resolve ranges, otherwise send the full body
+	size := resp.ContentLength
+	if size < 0 {
+		return resp, nil
+	}
+	// parse ranges, invalid range headers are ignored
+	ranges, err := parseRange(rangeHeader, size)
+	switch err {
+	case nil:
+		break
+	case errRangeNotSatisfiable:
+		{
+			resp.Body.Close()
+			resp.Status = "416 Requested Range Not Satisfiable"
+			resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			resp.Header.Del("Content-Type")
+			setResponseBody(resp, nil)
+			return resp, nil
+		}
+	default:
+		return resp, nil
+	}
+	// ranges add up to more than the full body, just send the full body
+	rangeTotal := int64(0)
+	for _, r := range ranges {
+		rangeTotal += r.length
+	}
+	if rangeTotal > size {
+		return resp, nil
+	}
+	// single range
+	if len(ranges) == 1 {
+		r := ranges[0]
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, r.start); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Status = "206 Partial Content"
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", r.contentRange(size))
+		resp.Header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		resp.Body = &storageReader{Reader: io.LimitReader(resp.Body, r.length), closers: []io.Closer{resp.Body}}
+		resp.ContentLength = r.length
+		return resp, nil
+	}
+	// multiple ranges, multipart/byteranges body
+	parts, err := readRanges(resp.Body, ranges)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for index, r := range ranges {
+		partHeader := make(textproto.MIMEHeader)
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		partHeader.Set("Content-Range", r.contentRange(size))
+		pw, err := mw.CreatePart(partHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(parts[index]); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	resp.Status = "206 Partial Content"
+	resp.StatusCode = http.StatusPartialContent
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	resp.Header.Del("Content-Range")
+	setResponseBody(resp, buf.Bytes())
+	return resp, nil
+}
+
+// readRanges - read the parts of given byte ranges from body in a single
+// pass, bytes outside of the ranges are skipped, returns the parts in the
+// order of the ranges
+func readRanges(body io.Reader, ranges []byteRange) ([][]byte, error) {
+	order := make([]int, len(ranges))
+	for index := range order {
+		order[index] = index
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return ranges[order[a]].start < ranges[order[b]].start
+	})
+	parts := make([][]byte, len(ranges))
+	pos := int64(0)
+	// part read last, it holds the bytes up to pos that overlapping
+	// ranges share
+	last := -1
+	for _, index := range order {
+		r := ranges[index]
+		part := make([]byte, 0, r.length)
+		if r.start < pos {
+			overlap := ranges[last]
+			end := r.start + r.length
+			if end > pos {
+				end = pos
+			}
+			part = append(part, parts[last][r.start-overlap.start:end-overlap.start]...)
+		} else if _, err := io.CopyN(ioutil.Discard, body, r.start-pos); err != nil {
+			return nil, err
+		} else {
+			pos = r.start
+		}
+		if remaining := r.start + r.length - pos; remaining > 0 {
+			buf := make([]byte, remaining)
+			if _, err := io.ReadFull(body, buf); err != nil {
+				return nil, err
+			}
+			part = append(part, buf...)
+			pos += remaining
+			last = index
+		}
+		parts[index] = part
+	}
+	return parts, nil
+}
@@ -0,0 +1,184 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		ranges []byteRange
+		err    bool
+	}{
+		{"single", "bytes=2-4", []byteRange{{2, 3}}, false},
+		{"open end", "bytes=7-", []byteRange{{7, 3}}, false},
+		{"end past size", "bytes=8-20", []byteRange{{8, 2}}, false},
+		{"suffix", "bytes=-3", []byteRange{{7, 3}}, false},
+		{"suffix past size", "bytes=-20", []byteRange{{0, 10}}, false},
+		{"multiple", "bytes=0-1, 5-6", []byteRange{{0, 2}, {5, 2}}, false},
+		{"overlapping", "bytes=0-5,3-8", []byteRange{{0, 6}, {3, 6}}, false},
+		{"start past size ignored", "bytes=0-1,20-30", []byteRange{{0, 2}}, false},
+		{"not satisfiable", "bytes=20-", nil, true},
+		{"zero suffix", "bytes=-0", nil, true},
+		{"invalid unit", "items=0-1", nil, true},
+		{"missing dash", "bytes=5", nil, true},
+		{"end before start", "bytes=5-2", nil, true},
+		{"not a number", "bytes=a-b", nil, true},
+		{"negative suffix", "bytes=--1", nil, true},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.header, 10)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("%s: got %v, want %v", test.name, ranges, test.ranges)
+		}
+	}
+}
+
+func TestReadRanges(t *testing.T) {
+	ranges := []byteRange{{5, 3}, {0, 2}, {6, 3}, {1, 8}, {7, 1}}
+	parts, err := readRanges(strings.NewReader("0123456789"), ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, want := range []string{"567", "01", "678", "12345678", "7"} {
+		if string(parts[index]) != want {
+			t.Errorf("part %d: got '%s', want '%s'", index, parts[index], want)
+		}
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		ifRange      string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"single", "bytes=2-4", "", 206, "bytes 2-4/10", "234"},
+		{"suffix", "bytes=-3", "", 206, "bytes 7-9/10", "789"},
+		{"not satisfiable", "bytes=20-", "", 416, "bytes */10", ""},
+		{"malformed", "bytes=5-2", "", 200, "", "0123456789"},
+		{"larger than body", "bytes=0-8,1-9", "", 200, "", "0123456789"},
+		{"if-range match", "bytes=0-1", `"v1"`, 206, "bytes 0-1/10", "01"},
+		{"if-range mismatch", "bytes=0-1", `"v2"`, 200, "", "0123456789"},
+	}
+	for _, test := range tests {
+		req := testReq("GET", "http://cache.test/range")
+		req.Header.Set("Range", test.rangeHeader)
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		resp, err := ServeRange(req, testResp(req, 200, "", "0123456789", map[string]string{
+			"ETag": `"v1"`,
+		}))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		body := readBody(t, resp)
+		if resp.StatusCode != test.status || resp.Header.Get("Content-Range") != test.contentRange || body != test.body {
+			t.Errorf("%s: got %d '%s' '%s'", test.name, resp.StatusCode, resp.Header.Get("Content-Range"), body)
+		}
+	}
+}
+
+func TestServeRangeMultipart(t *testing.T) {
+	req := testReq("GET", "http://cache.test/range")
+	req.Header.Set("Range", "bytes=5-6,0-1,-2")
+	resp, err := ServeRange(req, testResp(req, 200, "", "0123456789", map[string]string{
+		"Content-Type": "text/plain",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 206 {
+		t.Fatalf("expected partial content, got %d", resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected content type '%s'", resp.Header.Get("Content-Type"))
+	}
+	defer resp.Body.Close()
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	// parts are sent in the order they were asked for
+	for _, want := range []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 5-6/10", "56"},
+		{"bytes 0-1/10", "01"},
+		{"bytes 8-9/10", "89"},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Range") != want.contentRange || part.Header.Get("Content-Type") != "text/plain" || string(body) != want.body {
+			t.Errorf("got part '%s' '%s'", part.Header.Get("Content-Range"), body)
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Error("expected no more parts")
+	}
+}
+
+func TestRangeMissStoresFullResponse(t *testing.T) {
+	handler := testHandler(t, testConfig(t))
+	req := testReq("GET", "http://cache.test/range")
+	req.Header.Set("Range", "bytes=2-4")
+	if resp, _ := handler.OnRequest(req); resp != nil {
+		t.Fatal("expected miss")
+	}
+	// full response is fetched from upstream
+	if req.Header.Get("Range") != "" {
+		t.Fatal("range header sent upstream")
+	}
+	resp, err := handler.OnResponse(testResp(req, 200, "max-age=60", "0123456789", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 206 || readBody(t, resp) != "234" {
+		t.Fatalf("expected partial content, got %d", resp.StatusCode)
+	}
+	// rest of the body is stored after the client got its range
+	waitUntil(t, func() bool {
+		return handler.items.Len() == 1
+	})
+	resp, _ = handler.OnRequest(testReq("GET", "http://cache.test/range"))
+	if resp == nil || readBody(t, resp) != "0123456789" {
+		t.Fatal("expected cache hit with full body")
+	}
+}
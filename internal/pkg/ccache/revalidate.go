@@ -0,0 +1,133 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// revalidateContextKey - request context key used to mark sub requests
+// made to refresh a cache item, it holds the handler that made them
+type revalidateContextKey struct{}
+
+// refreshTimeout - max time a background refresh blocks other refreshes of the same item
+const refreshTimeout = 30 * time.Second
+
+// isRevalidateRequest - check if request is a refresh sub request made by this handler
+func (b *Handler) isRevalidateRequest(r *http.Request) bool {
+	handler, _ := r.Context().Value(revalidateContextKey{}).(*Handler)
+	return handler == b
+}
+
+// newRefreshRequest - create refresh sub request from client request, it
+// does not share any state with the client request so it can outlive it,
+// it is marked in its context so nothing extra is sent upstream
+func (b *Handler) newRefreshRequest(req *http.Request) *http.Request {
+	refreshReq := req.WithContext(context.WithValue(context.Background(), revalidateContextKey{}, b))
+	refreshReq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		refreshReq.Header[name] = append([]string(nil), values...)
+	}
+	return refreshReq
+}
+
+// refreshItem - fetch a fresh copy of a cache item's response from upstream
+// with given refresh sub request and store it in place of the cache item
+func (b *Handler) refreshItem(refreshReq *http.Request, item *Item) (*Item, error) {
+	// always fetch the full response, make request conditional so upstream
+	// can respond with not modified if the cached response is still valid
+	refreshReq.Header.Del("Range")
+	refreshReq.Header.Del("If-Range")
+	refreshReq.Header.Del("If-None-Match")
+	refreshReq.Header.Del("If-Modified-Since")
+	if etag := item.GetHeader("ETag"); etag != "" {
+		refreshReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := item.GetHeader("Last-Modified"); lastModified != "" {
+		refreshReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	// perform sub request
+	resp, err := b.subRequestCallback(refreshReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	if resp.Request == nil {
+		resp.Request = refreshReq
+	}
+	// store response, replaces or refreshes the expired item
+	newItem, err := b.Store(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if newItem == nil {
+		resp.Body.Close()
+		// upstream response is no longer cacheable
+		if resp.StatusCode < 500 {
+			item.LogAction("invalidate", "REASON = refreshed response not cacheable")
+			b.purgeItem(item)
+		}
+	}
+	return newItem, nil
+}
+
+// refreshItemAsync - refresh cache item in the background, only one refresh
+// per cache item is performed at a time
+func (b *Handler) refreshItemAsync(req *http.Request, item *Item) {
+	key := "refresh:" + item.Key
+	if b.collapser.Join(key, refreshTimeout) != nil {
+		return
+	}
+	refreshReq := b.newRefreshRequest(req)
+	go func() {
+		defer b.collapser.Release(key, 0)
+		item.LogAction("refresh", "-")
+		if _, err := b.refreshItem(refreshReq, item); err != nil {
+			item.LogAction("refresh", "ERROR = "+err.Error())
+		}
+	}()
+}
+
+// revalidateItem - revalidate expired cache item with upstream and wait for
+// the result, returns nil if no usable cache item is available afterwards
+func (b *Handler) revalidateItem(req *http.Request, item *Item) *Item {
+	key := "refresh:" + item.Key
+	// another request is already refreshing the item
+	if done := b.collapser.Join(key, refreshTimeout); done != nil {
+		if !waitFor(done, refreshTimeout, req) {
+			return nil
+		}
+		return b.Fetch(req)
+	}
+	defer b.collapser.Release(key, 0)
+	item.LogAction("revalidate", "-")
+	newItem, err := b.refreshItem(b.newRefreshRequest(req), item)
+	if err != nil {
+		item.LogAction("revalidate", "ERROR = "+err.Error())
+		return nil
+	}
+	if newItem == nil || newItem.HasExpired() {
+		return nil
+	}
+	return newItem
+}
@@ -0,0 +1,57 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRefreshRequest(t *testing.T) {
+	refreshed := make(chan *http.Request, 1)
+	var handler *Handler
+	handler = NewHandler(testConfig(t), func(req *http.Request) (*http.Response, error) {
+		// refresh goes through the handler like any other request
+		if resp, _ := handler.OnRequest(req); resp != nil {
+			t.Error("refresh request served from cache")
+		}
+		resp, err := handler.OnResponse(testResp(req, 200, "max-age=60", "fresh", nil))
+		refreshed <- req
+		return resp, err
+	})
+	t.Cleanup(handler.Close)
+	item, _ := handler.Store(testResp(testReq("GET", "http://cache.test/refresh"), 200, "max-age=60, stale-while-revalidate=60", "stale", nil))
+	ageItem(item, -61*time.Second)
+	resp, _ := handler.OnRequest(testReq("GET", "http://cache.test/refresh"))
+	if resp == nil || readBody(t, resp) != "stale" {
+		t.Fatal("expected stale hit")
+	}
+	req := <-refreshed
+	// refresh is marked in its context, not in headers sent upstream
+	if !handler.isRevalidateRequest(req) || len(req.Header) != len(testReq("GET", "http://cache.test/refresh").Header) {
+		t.Fatalf("unexpected refresh request headers %v", req.Header)
+	}
+	if handler.isRevalidateRequest(testReq("GET", "http://cache.test/refresh")) {
+		t.Fatal("client request taken for refresh request")
+	}
+	waitUntil(t, func() bool {
+		resp, _ := handler.OnRequest(testReq("GET", "http://cache.test/refresh"))
+		return resp != nil && readBody(t, resp) == "fresh"
+	})
+}
@@ -18,13 +18,13 @@ along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
 package ccache
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
 	"errors"
-	"net/http"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 )
 
 // CacheStorageFile - storage handler name for file system handler
@@ -36,16 +36,51 @@ const CacheStorageMemory = "memory"
 // CacheItemFileExtension - file extension to use for
 const CacheItemFileExtension = ".ccache"
 
-// Storage - define storage handler methods
+// CacheItemMetaFileExtension - file extension to use for cache item metadata
+const CacheItemMetaFileExtension = ".meta"
+
+// Storage - define storage handler methods, storage handlers only hold
+// the encoded response body, headers and codec are stored with the cache item
 type Storage interface {
 	Init(key string, config *Config)
 	GetTypeName() string
-	StoreResponse(r *http.Response) error
-	FetchResponse() (*http.Response, error)
+	Store(body io.Reader) (int64, error)
+	Fetch() (io.ReadCloser, error)
 	GetSize() (int64, error)
 	Delete() error
 }
 
+// storageReader - stream of a response body, closing it closes all
+// underlying readers
+type storageReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close - close underlying readers
+func (r *storageReader) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// MetaStorage - storage handler that can persist cache item metadata
+// alongside the stored response
+type MetaStorage interface {
+	StoreMeta(data []byte) error
+}
+
+// ExpiringStorage - storage handler that expires stored responses by
+// itself, the expiry applies to responses stored afterwards and to the
+// response already stored
+type ExpiringStorage interface {
+	SetExpiry(ttl time.Duration) error
+}
+
 // FileStorage - file system storage handler
 type FileStorage struct {
 	config *Config
@@ -75,53 +110,34 @@ func (s *FileStorage) getFilePath() (string, error) {
 	return cacheFilePath + s.key + CacheItemFileExtension, nil
 }
 
-// StoreResponse - store http response to file system
-func (s *FileStorage) StoreResponse(r *http.Response) error {
+// Store - store response body to file system, returns number of bytes stored
+func (s *FileStorage) Store(body io.Reader) (int64, error) {
 	// get file path
 	cacheFileName, err := s.getFilePath()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	// store cache item in tmp
+	// create cache file
 	f, err := os.Create(cacheFileName)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer f.Close()
-	gw, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	n, err := io.Copy(f, body)
 	if err != nil {
-		return err
+		f.Close()
+		return n, err
 	}
-	defer gw.Close()
-	return r.Write(gw)
+	return n, f.Close()
 }
 
-// FetchResponse - fetch response from file system
-func (s *FileStorage) FetchResponse() (*http.Response, error) {
+// Fetch - open stream of response body from file system
+func (s *FileStorage) Fetch() (io.ReadCloser, error) {
 	// get file path
 	cacheFileName, err := s.getFilePath()
 	if err != nil {
 		return nil, err
 	}
-	// open cached response, ungzip
-	f, err := os.Open(cacheFileName)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	gr, err := gzip.NewReader(f)
-	if err != nil {
-		return nil, err
-	}
-	defer gr.Close()
-	// read response buf in to memory
-	buf := &bytes.Buffer{}
-	_, err = buf.ReadFrom(gr)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
-	return resp, err
+	return os.Open(cacheFileName)
 }
 
 // GetSize - get file size of cache item
@@ -145,6 +161,22 @@ func (s *FileStorage) GetSize() (int64, error) {
 	return fi.Size(), nil
 }
 
+// StoreMeta - store cache item metadata next to the cache file
+func (s *FileStorage) StoreMeta(data []byte) error {
+	// get file path
+	cacheFileName, err := s.getFilePath()
+	if err != nil {
+		return err
+	}
+	metaFileName := strings.TrimSuffix(cacheFileName, CacheItemFileExtension) + CacheItemMetaFileExtension
+	// write to tmp file first so metadata is never partially written
+	err = ioutil.WriteFile(metaFileName+".tmp", data, 0660)
+	if err != nil {
+		return err
+	}
+	return os.Rename(metaFileName+".tmp", metaFileName)
+}
+
 // Delete - delete file
 func (s *FileStorage) Delete() error {
 	// get file path
@@ -152,6 +184,7 @@ func (s *FileStorage) Delete() error {
 	if err != nil {
 		return err
 	}
+	os.Remove(strings.TrimSuffix(cacheFileName, CacheItemFileExtension) + CacheItemMetaFileExtension)
 	return os.Remove(cacheFileName)
 }
 
@@ -174,32 +207,20 @@ func (s *MemoryStorage) GetTypeName() string {
 	return CacheStorageMemory
 }
 
-// StoreResponse - store http response to file system
-func (s *MemoryStorage) StoreResponse(r *http.Response) error {
+// Store - store response body in memory, returns number of bytes stored
+func (s *MemoryStorage) Store(body io.Reader) (int64, error) {
 	buf := bytes.NewBuffer(nil)
-	gw := gzip.NewWriter(buf)
-	defer gw.Close()
-	err := r.Write(gw)
+	n, err := io.Copy(buf, body)
 	if err != nil {
-		return err
+		return n, err
 	}
-	gw.Close()
-	s.data = make([]byte, buf.Len())
-	_, err = buf.Read(s.data)
-	return err
+	s.data = buf.Bytes()
+	return n, nil
 }
 
-// FetchResponse - fetch response from file system
-func (s *MemoryStorage) FetchResponse() (*http.Response, error) {
-	// read from memory, uncompress
-	br := bytes.NewReader(s.data)
-	gr, err := gzip.NewReader(br)
-	if err != nil {
-		return nil, err
-	}
-	defer gr.Close()
-	resp, err := http.ReadResponse(bufio.NewReader(gr), nil)
-	return resp, err
+// Fetch - open stream of response body from memory
+func (s *MemoryStorage) Fetch() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.data)), nil
 }
 
 // GetSize - get file size of cache item
@@ -224,6 +245,18 @@ func GetStorageHandler(name string) Storage {
 		{
 			return &MemoryStorage{}
 		}
+	case CacheStorageRedis:
+		{
+			return &RedisStorage{}
+		}
+	case CacheStorageMemcached:
+		{
+			return &MemcachedStorage{}
+		}
+	case CacheStorageS3:
+		{
+			return &S3Storage{}
+		}
 	}
 	return nil
 }
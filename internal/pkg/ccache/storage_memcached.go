@@ -0,0 +1,299 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// CacheStorageMemcached - storage handler name for memcached handler
+const CacheStorageMemcached = "memcached"
+
+// memcachedChunkSize - max size of a memcached value, stays below the
+// default 1MB item size limit to leave room for item overhead
+const memcachedChunkSize = 1000 * 1024
+
+// memcachedMaxRelativeExpiry - memcached treats expiry times larger than
+// 30 days as unix timestamps
+const memcachedMaxRelativeExpiry = 60 * 60 * 24 * 30
+
+// memcachedClients - memcached clients shared by all memcached storage
+// handlers, keyed by server list
+var memcachedClients = map[string]*memcache.Client{}
+
+// memcachedClientsMutex - guards memcached clients
+var memcachedClientsMutex sync.Mutex
+
+// getMemcachedClient - get shared memcached client for the servers in config
+func getMemcachedClient(config *Config) *memcache.Client {
+	memcachedClientsMutex.Lock()
+	defer memcachedClientsMutex.Unlock()
+	name := strings.Join(config.MemcachedServers, ",")
+	if memcachedClients[name] == nil {
+		memcachedClients[name] = memcache.New(config.MemcachedServers...)
+	}
+	return memcachedClients[name]
+}
+
+// memcachedExpiry - convert time to live in to memcached expiry value
+func memcachedExpiry(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds > memcachedMaxRelativeExpiry {
+		return int32(time.Now().Unix() + seconds)
+	}
+	return int32(seconds)
+}
+
+// memcachedManifest - lists the chunks a response is stored in
+type memcachedManifest struct {
+	chunks int
+	size   int64
+}
+
+// MemcachedStorage - memcached storage handler, responses are split in to
+// chunks stored under their own keys, a manifest key lists the chunks and
+// is written last so a partially stored response is never read, chunks
+// are fetched as they are read so deleting them waits for open readers
+type MemcachedStorage struct {
+	config        *Config
+	key           string
+	ttl           time.Duration
+	client        *memcache.Client
+	mutex         sync.Mutex
+	readers       int
+	pendingChunks int
+}
+
+// Init - init storage handler
+func (s *MemcachedStorage) Init(key string, config *Config) {
+	s.key = key
+	s.config = config
+	s.client = getMemcachedClient(config)
+}
+
+// GetTypeName - get storage handler name
+func (s *MemcachedStorage) GetTypeName() string {
+	return CacheStorageMemcached
+}
+
+// getManifestKey - get memcached key of chunk manifest
+func (s *MemcachedStorage) getManifestKey() (string, error) {
+	if s.key == "" {
+		return "", errors.New("cannot use memcached storage without cache key")
+	}
+	if s.config == nil {
+		return "", errors.New("cannot use memcached storage without config")
+	}
+	return s.config.MemcachedPrefix + s.key, nil
+}
+
+// getChunkKey - get memcached key of given chunk
+func (s *MemcachedStorage) getChunkKey(chunk int) string {
+	return fmt.Sprintf("%s%s.%d", s.config.MemcachedPrefix, s.key, chunk)
+}
+
+// fetchManifest - fetch chunk manifest of stored response
+func (s *MemcachedStorage) fetchManifest() (memcachedManifest, error) {
+	manifest := memcachedManifest{}
+	manifestKey, err := s.getManifestKey()
+	if err != nil {
+		return manifest, err
+	}
+	item, err := s.client.Get(manifestKey)
+	if err != nil {
+		return manifest, err
+	}
+	if _, err := fmt.Sscanf(string(item.Value), "%d %d", &manifest.chunks, &manifest.size); err != nil {
+		return manifest, fmt.Errorf("invalid memcached manifest '%s'", item.Value)
+	}
+	return manifest, nil
+}
+
+// Store - store response body in memcached, returns number of bytes stored
+func (s *MemcachedStorage) Store(body io.Reader) (int64, error) {
+	manifestKey, err := s.getManifestKey()
+	if err != nil {
+		return 0, err
+	}
+	expiry := memcachedExpiry(s.ttl)
+	manifest := memcachedManifest{}
+	buf := make([]byte, memcachedChunkSize)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			value := append([]byte(nil), buf[:n]...)
+			if setErr := s.client.Set(&memcache.Item{Key: s.getChunkKey(manifest.chunks), Value: value, Expiration: expiry}); setErr != nil {
+				s.deleteChunks(manifest.chunks)
+				return manifest.size, setErr
+			}
+			manifest.chunks++
+			manifest.size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			s.deleteChunks(manifest.chunks)
+			return manifest.size, err
+		}
+	}
+	err = s.client.Set(&memcache.Item{
+		Key:        manifestKey,
+		Value:      []byte(fmt.Sprintf("%d %d", manifest.chunks, manifest.size)),
+		Expiration: expiry,
+	})
+	if err != nil {
+		s.deleteChunks(manifest.chunks)
+	}
+	return manifest.size, err
+}
+
+// Fetch - open stream of response body from memcached, chunks are fetched
+// as they are read
+func (s *MemcachedStorage) Fetch() (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	manifest, err := s.fetchManifest()
+	if err != nil {
+		return nil, err
+	}
+	s.readers++
+	return &memcachedReader{storage: s, manifest: manifest}, nil
+}
+
+// release - release reader of stored response, chunks of a response that
+// was deleted while it was read are deleted once the last reader is done
+func (s *MemcachedStorage) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readers--
+	if s.readers == 0 && s.pendingChunks > 0 {
+		s.deleteChunks(s.pendingChunks)
+		s.pendingChunks = 0
+	}
+}
+
+// GetSize - get size of response stored in memcached
+func (s *MemcachedStorage) GetSize() (int64, error) {
+	manifest, err := s.fetchManifest()
+	if err != nil {
+		return 0, err
+	}
+	return manifest.size, nil
+}
+
+// SetExpiry - set time after which memcached removes the stored response
+func (s *MemcachedStorage) SetExpiry(ttl time.Duration) error {
+	s.ttl = ttl
+	manifest, err := s.fetchManifest()
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	expiry := memcachedExpiry(ttl)
+	for chunk := 0; chunk < manifest.chunks; chunk++ {
+		if err := s.client.Touch(s.getChunkKey(chunk), expiry); err != nil {
+			return err
+		}
+	}
+	manifestKey, _ := s.getManifestKey()
+	return s.client.Touch(manifestKey, expiry)
+}
+
+// deleteChunks - delete given number of chunks
+func (s *MemcachedStorage) deleteChunks(chunks int) {
+	for chunk := 0; chunk < chunks; chunk++ {
+		s.client.Delete(s.getChunkKey(chunk))
+	}
+}
+
+// Delete - delete stored response, the manifest is deleted right away so
+// it can no longer be fetched, chunks are kept until open readers are done
+func (s *MemcachedStorage) Delete() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	manifest, err := s.fetchManifest()
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	manifestKey, _ := s.getManifestKey()
+	err = s.client.Delete(manifestKey)
+	if s.readers > 0 {
+		s.pendingChunks = manifest.chunks
+	} else {
+		s.deleteChunks(manifest.chunks)
+	}
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// memcachedReader - stream of a response stored in memcached chunks
+type memcachedReader struct {
+	storage  *MemcachedStorage
+	manifest memcachedManifest
+	chunk    int
+	data     []byte
+	closed   bool
+}
+
+// Read - read from current chunk, fetching the next chunk once it is read
+func (r *memcachedReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.chunk >= r.manifest.chunks {
+			return 0, io.EOF
+		}
+		item, err := r.storage.client.Get(r.storage.getChunkKey(r.chunk))
+		if err != nil {
+			return 0, fmt.Errorf("could not fetch chunk %d of %d, %s", r.chunk+1, r.manifest.chunks, err.Error())
+		}
+		r.data = item.Value
+		r.chunk++
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Close - close stream
+func (r *memcachedReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.data = nil
+	r.chunk = r.manifest.chunks
+	r.storage.release()
+	return nil
+}
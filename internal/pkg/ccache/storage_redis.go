@@ -0,0 +1,459 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// CacheStorageRedis - storage handler name for redis handler
+const CacheStorageRedis = "redis"
+
+// redisClients - redis clients shared by all redis storage handlers, keyed
+// by server address and database
+var redisClients = map[string]*redis.Client{}
+
+// redisClientsMutex - guards redis clients
+var redisClientsMutex sync.Mutex
+
+// getRedisClient - get shared redis client for the server in config
+func getRedisClient(config *Config) *redis.Client {
+	redisClientsMutex.Lock()
+	defer redisClientsMutex.Unlock()
+	name := fmt.Sprintf("%s/%d", config.RedisAddress, config.RedisDB)
+	if redisClients[name] == nil {
+		redisClients[name] = redis.NewClient(&redis.Options{
+			Addr:     config.RedisAddress,
+			Password: config.RedisPassword,
+			DB:       config.RedisDB,
+		})
+	}
+	return redisClients[name]
+}
+
+// CacheItemVaryExtension - redis key extension of the vary headers of the
+// cache items with a base key
+const CacheItemVaryExtension = ".vary"
+
+// RedisStorage - redis storage handler, stored responses are shared with
+// every cache using the same redis server and key prefix, their metadata is
+// stored under the cache key so other caches can look them up on a miss
+type RedisStorage struct {
+	config *Config
+	key    string
+	ttl    time.Duration
+	client *redis.Client
+}
+
+// redisSetURL - kind of redis set holding the metadata keys of the cache
+// items for an url
+const redisSetURL = "url"
+
+// redisSetTag - kind of redis set holding the metadata keys of the cache
+// items tagged with a tag
+const redisSetTag = "tag"
+
+// redisItemKeys - keys of cache item read from its metadata
+type redisItemKeys struct {
+	Key        string
+	BaseKey    string
+	Vary       []string
+	URL        string
+	Tags       []string
+	StorageKey string
+}
+
+// Init - init storage handler
+func (s *RedisStorage) Init(key string, config *Config) {
+	s.key = key
+	s.config = config
+	s.client = getRedisClient(config)
+}
+
+// GetTypeName - get storage handler name
+func (s *RedisStorage) GetTypeName() string {
+	return CacheStorageRedis
+}
+
+// getRedisKey - get redis key of stored response
+func (s *RedisStorage) getRedisKey() (string, error) {
+	if s.key == "" {
+		return "", errors.New("cannot use redis storage without cache key")
+	}
+	if s.config == nil {
+		return "", errors.New("cannot use redis storage without config")
+	}
+	return s.config.RedisPrefix + s.key + CacheItemFileExtension, nil
+}
+
+// getRedisMetaKey - get redis key of metadata of cache item with given key
+func getRedisMetaKey(key string, config *Config) string {
+	return config.RedisPrefix + key + CacheItemMetaFileExtension
+}
+
+// getRedisSetKey - get redis key of set of given kind, the metadata keys of
+// cache items with given url or tag are added to it so they can be purged
+// by caches that never stored them
+func getRedisSetKey(kind string, value string, config *Config) string {
+	return fmt.Sprintf("%s%s:%x", config.RedisPrefix, kind, md5.Sum([]byte(value)))
+}
+
+// getRedisVaryKey - get redis key of vary headers of cache items with
+// given base key
+func getRedisVaryKey(baseKey string, config *Config) string {
+	return config.RedisPrefix + baseKey + CacheItemVaryExtension
+}
+
+// Store - store response body in redis, returns number of bytes stored
+func (s *RedisStorage) Store(body io.Reader) (int64, error) {
+	redisKey, err := s.getRedisKey()
+	if err != nil {
+		return 0, err
+	}
+	buf := bytes.NewBuffer(nil)
+	n, err := io.Copy(buf, body)
+	if err != nil {
+		return n, err
+	}
+	return n, s.client.Set(redisKey, buf.Bytes(), s.ttl).Err()
+}
+
+// Fetch - open stream of response body from redis
+func (s *RedisStorage) Fetch() (io.ReadCloser, error) {
+	redisKey, err := s.getRedisKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.client.Get(redisKey).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// GetSize - get size of response stored in redis
+func (s *RedisStorage) GetSize() (int64, error) {
+	redisKey, err := s.getRedisKey()
+	if err != nil {
+		return 0, err
+	}
+	return s.client.StrLen(redisKey).Result()
+}
+
+// SetExpiry - set time after which redis removes the stored response, the
+// metadata gets the same expiry when it is next stored
+func (s *RedisStorage) SetExpiry(ttl time.Duration) error {
+	s.ttl = ttl
+	redisKey, err := s.getRedisKey()
+	if err != nil {
+		return err
+	}
+	// keys that don't exist yet are ignored
+	return s.client.Expire(redisKey, ttl).Err()
+}
+
+// StoreMeta - store cache item metadata under its cache key, replacing
+// metadata stored for the same key by other caches along with the response
+// it refers to, and the headers it varies on under its base key
+func (s *RedisStorage) StoreMeta(data []byte) error {
+	if s.config == nil {
+		return errors.New("cannot use redis storage without config")
+	}
+	keys := redisItemKeys{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	if keys.Key == "" || keys.StorageKey != s.key {
+		return errors.New("invalid metadata")
+	}
+	vary, err := json.Marshal(keys.Vary)
+	if err != nil {
+		return err
+	}
+	metaKey := getRedisMetaKey(keys.Key, s.config)
+	setKeys := []string{getRedisSetKey(redisSetURL, keys.URL, s.config)}
+	for _, tag := range keys.Tags {
+		setKeys = append(setKeys, getRedisSetKey(redisSetTag, tag, s.config))
+	}
+	var replaced *redis.StringCmd
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(getRedisVaryKey(keys.BaseKey, s.config), vary, s.ttl)
+		replaced = pipe.GetSet(metaKey, data)
+		if s.ttl > 0 {
+			pipe.Expire(metaKey, s.ttl)
+		}
+		for _, setKey := range setKeys {
+			pipe.SAdd(setKey, metaKey)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	// response of replaced metadata can no longer be looked up
+	replacedKeys := redisItemKeys{}
+	if data, err := replaced.Bytes(); err == nil && json.Unmarshal(data, &replacedKeys) == nil {
+		if replacedKeys.StorageKey != "" && replacedKeys.StorageKey != s.key {
+			s.client.Del(s.config.RedisPrefix + replacedKeys.StorageKey + CacheItemFileExtension)
+		}
+	}
+	// sets are shared by cache items with different expiries, only ever
+	// extend them
+	for _, setKey := range setKeys {
+		if s.client.TTL(setKey).Val() < s.ttl {
+			s.client.Expire(setKey, s.ttl)
+		}
+	}
+	return nil
+}
+
+// Delete - stored responses are shared with other caches, they are kept
+// when a cache drops its item until redis expires them, the item is
+// purged or another response is stored under its cache key
+func (s *RedisStorage) Delete() error {
+	return nil
+}
+
+// redisMissCache - base keys of responses recently not found in redis,
+// they are not looked up again until their entry expires
+type redisMissCache struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+}
+
+// newRedisMissCache - create new empty redis miss cache
+func newRedisMissCache() *redisMissCache {
+	return &redisMissCache{
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Has - check if response with given base key was recently not found
+func (c *redisMissCache) Has(baseKey string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expires, ok := c.expires[baseKey]
+	if ok && !time.Now().Before(expires) {
+		delete(c.expires, baseKey)
+		return false
+	}
+	return ok
+}
+
+// Add - remember response with given base key was not found until given time
+func (c *redisMissCache) Add(baseKey string, until time.Time) {
+	if !time.Now().Before(until) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expires[baseKey] = until
+}
+
+// Remove - forget that response with given base key was not found
+func (c *redisMissCache) Remove(baseKey string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.expires, baseKey)
+}
+
+// Clean - remove expired entries
+func (c *redisMissCache) Clean() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for baseKey, expires := range c.expires {
+		if !now.Before(expires) {
+			delete(c.expires, baseKey)
+		}
+	}
+}
+
+// FetchRedisItem - look up variant of cache item with given base key
+// selected by request in redis, returns nil if no cache has stored it
+func FetchRedisItem(baseKey string, r *http.Request, config *Config) *Item {
+	client := getRedisClient(config)
+	vary := make([]string, 0)
+	data, err := client.Get(getRedisVaryKey(baseKey, config)).Bytes()
+	if err == nil {
+		err = json.Unmarshal(data, &vary)
+	}
+	if err != nil && err != redis.Nil {
+		log.Printf("CACHE :: FETCH :: redis :: ERROR = %s", err.Error())
+		return nil
+	}
+	metaKey := getRedisMetaKey(VariantKeyFromRequest(baseKey, r, vary), config)
+	data, err = client.Get(metaKey).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("CACHE :: FETCH :: redis :: ERROR = %s", err.Error())
+		}
+		return nil
+	}
+	keys := redisItemKeys{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		log.Printf("CACHE :: FETCH :: redis :: ERROR = %s", err.Error())
+		return nil
+	}
+	storage := &RedisStorage{}
+	storage.Init(keys.StorageKey, config)
+	item, err := itemFromMeta(data, keys.StorageKey, storage)
+	if err != nil {
+		log.Printf("CACHE :: FETCH :: %s :: ERROR = %s", keys.StorageKey, err.Error())
+		return nil
+	}
+	if item.CanDiscard() {
+		return nil
+	}
+	item.LogAction("load", "-")
+	return item
+}
+
+// PurgeRedisItem - remove response stored in redis for the cache key of
+// given item, by this or any other cache
+func PurgeRedisItem(item *Item, config *Config) error {
+	client := getRedisClient(config)
+	item.mutex.RLock()
+	key := item.Key
+	storageKey := item.StorageKey
+	item.mutex.RUnlock()
+	return purgeRedisMeta(client, []string{getRedisMetaKey(key, config)}, []string{
+		config.RedisPrefix + storageKey + CacheItemFileExtension,
+	}, config)
+}
+
+// PurgeRedisItems - remove responses stored in redis for any of the given
+// urls or tags, by this or any other cache
+func PurgeRedisItems(urls []string, tags []string, config *Config) error {
+	client := getRedisClient(config)
+	setKeys := getRedisSetKeys(urls, tags, config)
+	if len(setKeys) == 0 {
+		return nil
+	}
+	metaKeys, err := client.SUnion(setKeys...).Result()
+	if err != nil {
+		return err
+	}
+	return purgeRedisMeta(client, metaKeys, setKeys, config)
+}
+
+// ExpireRedisItem - expire response stored in redis for the cache key of
+// given item, by this or any other cache, it can be served stale for at
+// least the grace given
+func ExpireRedisItem(item *Item, grace int32, config *Config) error {
+	item.mutex.RLock()
+	key := item.Key
+	item.mutex.RUnlock()
+	return expireRedisMeta(getRedisClient(config), []string{getRedisMetaKey(key, config)}, grace, config)
+}
+
+// ExpireRedisItems - expire responses stored in redis for any of the given
+// urls or tags, by this or any other cache, they can be served stale for
+// at least the grace given
+func ExpireRedisItems(urls []string, tags []string, grace int32, config *Config) error {
+	client := getRedisClient(config)
+	setKeys := getRedisSetKeys(urls, tags, config)
+	if len(setKeys) == 0 {
+		return nil
+	}
+	metaKeys, err := client.SUnion(setKeys...).Result()
+	if err != nil {
+		return err
+	}
+	return expireRedisMeta(client, metaKeys, grace, config)
+}
+
+// getRedisSetKeys - get redis keys of the sets of given urls and tags
+func getRedisSetKeys(urls []string, tags []string, config *Config) []string {
+	setKeys := make([]string, 0, len(urls)+len(tags))
+	for _, url := range urls {
+		setKeys = append(setKeys, getRedisSetKey(redisSetURL, url, config))
+	}
+	for _, tag := range tags {
+		setKeys = append(setKeys, getRedisSetKey(redisSetTag, tag, config))
+	}
+	return setKeys
+}
+
+// expireRedisMeta - expire cache items with given metadata keys and store
+// their updated metadata
+func expireRedisMeta(client *redis.Client, metaKeys []string, grace int32, config *Config) error {
+	if len(metaKeys) == 0 {
+		return nil
+	}
+	values, err := client.MGet(metaKeys...).Result()
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		keys := redisItemKeys{}
+		if json.Unmarshal([]byte(data), &keys) != nil || keys.StorageKey == "" {
+			continue
+		}
+		storage := &RedisStorage{}
+		storage.Init(keys.StorageKey, config)
+		item, err := itemFromMeta([]byte(data), keys.StorageKey, storage)
+		if err != nil {
+			continue
+		}
+		item.Expire(grace)
+	}
+	return nil
+}
+
+// purgeRedisMeta - delete given metadata keys, the responses they refer to
+// and the other keys given
+func purgeRedisMeta(client *redis.Client, metaKeys []string, redisKeys []string, config *Config) error {
+	if len(metaKeys) > 0 {
+		values, err := client.MGet(metaKeys...).Result()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			keys := redisItemKeys{}
+			if json.Unmarshal([]byte(data), &keys) == nil && keys.StorageKey != "" {
+				redisKeys = append(redisKeys, config.RedisPrefix+keys.StorageKey+CacheItemFileExtension)
+			}
+		}
+	}
+	redisKeys = append(redisKeys, metaKeys...)
+	if len(redisKeys) == 0 {
+		return nil
+	}
+	return client.Del(redisKeys...).Err()
+}
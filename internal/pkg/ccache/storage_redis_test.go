@@ -0,0 +1,196 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testRedisConfig - config with given redis as the only storage handler
+func testRedisConfig(t *testing.T, server *miniredis.Miniredis) Config {
+	config := testConfig(t)
+	config.RedisAddress = server.Addr()
+	config.CacheStorageHandlers = []string{CacheStorageRedis}
+	return config
+}
+
+// testRedisReq - create request that accepts given content type
+func testRedisReq(method string, url string, accept string) *http.Request {
+	req := testReq(method, url)
+	req.Header.Set("Accept", accept)
+	return req
+}
+
+func TestRedisSharedCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := testHandler(t, testRedisConfig(t, server))
+	second := testHandler(t, testRedisConfig(t, server))
+	body := strings.Repeat("redis ", 100)
+	req := testRedisReq("GET", "http://cache.test/shared", "text/html")
+	item, err := first.Store(testResp(req, 200, "max-age=60", body, map[string]string{"Vary": "Accept"}))
+	if err != nil || item == nil {
+		t.Fatal("not stored", err)
+	}
+	ttl := server.TTL(first.Config.RedisPrefix + item.StorageKey + CacheItemFileExtension)
+	if ttl <= 60*time.Second || ttl > 400*time.Second {
+		t.Fatal("unexpected ttl", ttl)
+	}
+	// second cache finds the variant the first one stored
+	resp, _ := second.OnRequest(testRedisReq("GET", "http://cache.test/shared", "text/html"))
+	if resp == nil || readBody(t, resp) != body {
+		t.Fatal("expected hit from redis")
+	}
+	resp, _ = second.OnRequest(testRedisReq("GET", "http://cache.test/shared", "application/json"))
+	if resp != nil {
+		t.Fatal("expected miss for other variant")
+	}
+	// response expired by redis is a miss
+	server.FastForward(time.Hour)
+	resp, _ = first.OnRequest(testRedisReq("GET", "http://cache.test/shared", "text/html"))
+	if resp != nil {
+		t.Fatal("expected miss after redis expiry")
+	}
+}
+
+func TestRedisEvictionKeepsSharedEntry(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := testRedisConfig(t, server)
+	config.CacheStorageHandlers = []string{CacheStorageMemory, CacheStorageRedis}
+	handler := testHandler(t, config)
+	item, _ := handler.Store(testResp(testReq("GET", "http://cache.test/tier"), 200, "max-age=60", "tier", nil))
+	if err := item.MoveStorage(CacheStorageRedis, &handler.Config); err != nil {
+		t.Fatal(err)
+	}
+	keys := len(server.Keys())
+	handler.removeItem(item)
+	if len(server.Keys()) != keys {
+		t.Fatal("local eviction removed shared entry", server.Keys())
+	}
+	// evicted item is looked up in redis again
+	resp, _ := handler.OnRequest(testReq("GET", "http://cache.test/tier"))
+	if resp == nil || readBody(t, resp) != "tier" {
+		t.Fatal("expected hit from redis")
+	}
+}
+
+func TestRedisPurge(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := testHandler(t, testRedisConfig(t, server))
+	second := testHandler(t, testRedisConfig(t, server))
+	first.Store(testResp(testReq("GET", "http://cache.test/purge"), 200, "max-age=60", "purge", nil))
+	if err := second.Invalidate(testReq("PURGE", "http://cache.test/purge")); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Keys()) != 1 {
+		t.Fatal("expected only vary headers to be left", server.Keys())
+	}
+	resp, _ := testHandler(t, testRedisConfig(t, server)).OnRequest(testReq("GET", "http://cache.test/purge"))
+	if resp != nil {
+		t.Fatal("expected miss after purge")
+	}
+}
+
+func TestRedisPurgeTags(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := testHandler(t, testRedisConfig(t, server))
+	second := testHandler(t, testRedisConfig(t, server))
+	first.Store(testResp(testReq("GET", "http://cache.test/news"), 200, "max-age=60", "news", map[string]string{"Xkey": "news"}))
+	first.Store(testResp(testReq("GET", "http://cache.test/sport"), 200, "max-age=60", "sport", map[string]string{"Xkey": "sport"}))
+	req := testReq("PURGE", "http://cache.test/")
+	req.Header.Set("Xkey", "news")
+	if err := second.Invalidate(req); err != nil {
+		t.Fatal(err)
+	}
+	third := testHandler(t, testRedisConfig(t, server))
+	if resp, _ := third.OnRequest(testReq("GET", "http://cache.test/news")); resp != nil {
+		t.Fatal("expected miss for purged tag")
+	}
+	if resp, _ := third.OnRequest(testReq("GET", "http://cache.test/sport")); resp == nil || readBody(t, resp) != "sport" {
+		t.Fatal("expected hit for other tag")
+	}
+}
+
+func TestRedisSoftPurge(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := testHandler(t, testRedisConfig(t, server))
+	second := testHandler(t, testRedisConfig(t, server))
+	first.Store(testResp(testReq("GET", "http://cache.test/soft"), 200, "max-age=60", "soft", nil))
+	if err := second.Invalidate(testReq("SOFTPURGE", "http://cache.test/soft")); err != nil {
+		t.Fatal(err)
+	}
+	// shared copy is expired but still served stale
+	resp, _ := testHandler(t, testRedisConfig(t, server)).OnRequest(testReq("GET", "http://cache.test/soft"))
+	if resp == nil || resp.Header.Get("X-Cache") != "STALE" || readBody(t, resp) != "soft" {
+		t.Fatal("expected stale hit after soft purge")
+	}
+}
+
+func TestRedisReplaceDeletesOldResponse(t *testing.T) {
+	server := miniredis.RunT(t)
+	handler := testHandler(t, testRedisConfig(t, server))
+	old, _ := handler.Store(testResp(testReq("GET", "http://cache.test/replace"), 200, "max-age=60", "old", nil))
+	if old == nil {
+		t.Fatal("not stored")
+	}
+	ageItem(old, -61*time.Second)
+	item, _ := handler.Store(testResp(testReq("GET", "http://cache.test/replace"), 200, "max-age=60", "new", nil))
+	if item == nil || item == old {
+		t.Fatal("not replaced")
+	}
+	// response of the replaced metadata can no longer be looked up
+	if server.Exists(handler.Config.RedisPrefix + old.StorageKey + CacheItemFileExtension) {
+		t.Fatal("replaced response kept")
+	}
+	if !server.Exists(handler.Config.RedisPrefix + item.StorageKey + CacheItemFileExtension) {
+		t.Fatal("new response not stored")
+	}
+}
+
+func TestRedisMissNotRepeated(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := testHandler(t, testRedisConfig(t, server))
+	if first.Fetch(testReq("GET", "http://cache.test/miss")) != nil {
+		t.Fatal("expected miss")
+	}
+	commands := server.CommandCount()
+	if first.Fetch(testReq("GET", "http://cache.test/miss")) != nil {
+		t.Fatal("expected miss")
+	}
+	if server.CommandCount() != commands {
+		t.Fatal("redis looked up again after a miss")
+	}
+	// stored by another cache, found once the miss expires
+	second := testHandler(t, testRedisConfig(t, server))
+	second.Store(testResp(testReq("GET", "http://cache.test/miss"), 200, "max-age=60", "miss", nil))
+	if first.Fetch(testReq("GET", "http://cache.test/miss")) != nil {
+		t.Fatal("expected miss to be remembered")
+	}
+	first.redisMisses.mutex.Lock()
+	for baseKey := range first.redisMisses.expires {
+		first.redisMisses.expires[baseKey] = time.Now()
+	}
+	first.redisMisses.mutex.Unlock()
+	if first.Fetch(testReq("GET", "http://cache.test/miss")) == nil {
+		t.Fatal("expected hit from redis")
+	}
+}
@@ -0,0 +1,268 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// CacheStorageS3 - storage handler name for s3 compatible object storage handler
+const CacheStorageS3 = "s3"
+
+// s3PartSize - size of parts responses of unknown length are uploaded in
+const s3PartSize = 16 * 1024 * 1024
+
+// s3Clients - s3 clients shared by all s3 storage handlers, keyed by endpoint
+var s3Clients = map[string]*minio.Client{}
+
+// s3ClientsMutex - guards s3 clients
+var s3ClientsMutex sync.Mutex
+
+// getS3Client - get shared s3 client for the endpoint in config
+func getS3Client(config *Config) (*minio.Client, error) {
+	s3ClientsMutex.Lock()
+	defer s3ClientsMutex.Unlock()
+	name := config.S3Endpoint + "/" + config.S3AccessKey
+	if s3Clients[name] == nil {
+		client, err := minio.New(config.S3Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, ""),
+			Secure: config.S3Secure,
+			Region: config.S3Region,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s3Clients[name] = client
+	}
+	return s3Clients[name], nil
+}
+
+// S3Storage - s3 compatible object storage handler, meant as a large
+// tier below the file system for long lived responses
+type S3Storage struct {
+	config *Config
+	key    string
+	client *minio.Client
+	err    error
+}
+
+// Init - init storage handler
+func (s *S3Storage) Init(key string, config *Config) {
+	s.key = key
+	s.config = config
+	s.client, s.err = getS3Client(config)
+}
+
+// GetTypeName - get storage handler name
+func (s *S3Storage) GetTypeName() string {
+	return CacheStorageS3
+}
+
+// getObjectName - get name of object with given extension
+func (s *S3Storage) getObjectName(extension string) (string, error) {
+	if s.key == "" {
+		return "", errors.New("cannot use s3 storage without cache key")
+	}
+	if s.config == nil {
+		return "", errors.New("cannot use s3 storage without config")
+	}
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.config.S3Prefix + s.key + extension, nil
+}
+
+// Store - store response body in s3, returns number of bytes stored
+func (s *S3Storage) Store(body io.Reader) (int64, error) {
+	objectName, err := s.getObjectName(CacheItemFileExtension)
+	if err != nil {
+		return 0, err
+	}
+	// bodies that fit in one part are uploaded with a single request,
+	// larger ones are streamed as a multipart upload
+	buf := bytes.NewBuffer(nil)
+	n, err := io.CopyN(buf, body, s3PartSize)
+	size := int64(-1)
+	switch err {
+	case io.EOF:
+		{
+			size = n
+			body = buf
+			break
+		}
+	case nil:
+		{
+			body = io.MultiReader(buf, body)
+			break
+		}
+	default:
+		{
+			return n, err
+		}
+	}
+	info, err := s.client.PutObject(
+		context.Background(), s.config.S3Bucket, objectName, body, size,
+		minio.PutObjectOptions{PartSize: s3PartSize},
+	)
+	return info.Size, err
+}
+
+// Fetch - open stream of response body from s3
+func (s *S3Storage) Fetch() (io.ReadCloser, error) {
+	objectName, err := s.getObjectName(CacheItemFileExtension)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.client.GetObject(context.Background(), s.config.S3Bucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// objects are fetched lazily, make sure it exists before streaming it
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+// GetSize - get size of response stored in s3
+func (s *S3Storage) GetSize() (int64, error) {
+	objectName, err := s.getObjectName(CacheItemFileExtension)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.client.StatObject(context.Background(), s.config.S3Bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// StoreMeta - store cache item metadata next to the stored response
+func (s *S3Storage) StoreMeta(data []byte) error {
+	objectName, err := s.getObjectName(CacheItemMetaFileExtension)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(
+		context.Background(), s.config.S3Bucket, objectName, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"},
+	)
+	return err
+}
+
+// fetchMeta - fetch cache item metadata stored next to the stored response
+func (s *S3Storage) fetchMeta() ([]byte, error) {
+	objectName, err := s.getObjectName(CacheItemMetaFileExtension)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.client.GetObject(context.Background(), s.config.S3Bucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return ioutil.ReadAll(object)
+}
+
+// Delete - delete stored response and metadata
+func (s *S3Storage) Delete() error {
+	objectName, err := s.getObjectName(CacheItemFileExtension)
+	if err != nil {
+		return err
+	}
+	metaObjectName, _ := s.getObjectName(CacheItemMetaFileExtension)
+	s.client.RemoveObject(context.Background(), s.config.S3Bucket, metaObjectName, minio.RemoveObjectOptions{})
+	return s.client.RemoveObject(context.Background(), s.config.S3Bucket, objectName, minio.RemoveObjectOptions{})
+}
+
+// ClearS3Items - delete all objects stored under the s3 prefix
+func ClearS3Items(config *Config) {
+	client, err := getS3Client(config)
+	if err != nil {
+		log.Printf("CACHE :: CLEAR :: s3 :: ERROR = %s", err.Error())
+		return
+	}
+	objects := client.ListObjects(context.Background(), config.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    config.S3Prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			log.Printf("CACHE :: CLEAR :: s3 :: ERROR = %s", object.Err.Error())
+			continue
+		}
+		if err := client.RemoveObject(context.Background(), config.S3Bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("CACHE :: CLEAR :: s3 :: ERROR = %s", err.Error())
+		}
+	}
+}
+
+// LoadS3Items - load cache items stored in s3
+func LoadS3Items(config *Config) []*Item {
+	items := make([]*Item, 0)
+	client, err := getS3Client(config)
+	if err != nil {
+		log.Printf("CACHE :: LOAD :: s3 :: ERROR = %s", err.Error())
+		return items
+	}
+	objects := client.ListObjects(context.Background(), config.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    config.S3Prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			log.Printf("CACHE :: LOAD :: s3 :: ERROR = %s", object.Err.Error())
+			continue
+		}
+		if !strings.HasSuffix(object.Key, CacheItemMetaFileExtension) {
+			continue
+		}
+		storageKey := strings.TrimSuffix(strings.TrimPrefix(object.Key, config.S3Prefix), CacheItemMetaFileExtension)
+		storage := &S3Storage{}
+		storage.Init(storageKey, config)
+		data, err := storage.fetchMeta()
+		if err != nil {
+			continue
+		}
+		item, err := itemFromMeta(data, storageKey, storage)
+		if err != nil {
+			log.Printf("CACHE :: LOAD :: %s :: ERROR = %s", storageKey, err.Error())
+			storage.Delete()
+			continue
+		}
+		if item.CanDiscard() {
+			item.LogAction("invalidate", "REASON = max age expired")
+			item.Clear()
+			continue
+		}
+		item.LogAction("load", "-")
+		items = append(items, item)
+	}
+	return items
+}
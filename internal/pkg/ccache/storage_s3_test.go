@@ -0,0 +1,273 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 - in memory s3 server implementing the calls made by the s3 storage
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	listing chan struct{}
+}
+
+// fakeS3ListResult - result of list objects v2 call
+type fakeS3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Name     string
+	Contents []fakeS3Object
+}
+
+// fakeS3Object - object in list objects result
+type fakeS3Object struct {
+	Key          string
+	Size         int
+	LastModified string
+}
+
+// newFakeS3 - start fake s3 server, returns its host
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	s3 := &fakeS3{
+		objects: make(map[string][]byte),
+	}
+	server := httptest.NewServer(s3)
+	t.Cleanup(server.Close)
+	return s3, strings.TrimPrefix(server.URL, "http://")
+}
+
+// Len - get number of stored objects
+func (s *fakeS3) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.objects)
+}
+
+// ServeHTTP - handle s3 request, paths are /bucket/key
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+		s.mutex.Lock()
+		listing := s.listing
+		s.mutex.Unlock()
+		if listing != nil {
+			<-listing
+		}
+		s.list(w, r, strings.TrimSuffix(path, "/"))
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch r.Method {
+	case "PUT":
+		{
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+				body = decodeAwsChunked(body)
+			}
+			s.objects[path] = body
+			w.Header().Set("ETag", `"etag"`)
+			break
+		}
+	case "GET", "HEAD":
+		{
+			body, ok := s.objects[path]
+			if !ok {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusNotFound)
+				if r.Method == "GET" {
+					w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+				}
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("ETag", `"etag"`)
+			if r.Method == "GET" {
+				w.Write(body)
+			}
+			break
+		}
+	case "DELETE":
+		{
+			delete(s.objects, path)
+			w.WriteHeader(http.StatusNoContent)
+			break
+		}
+	}
+}
+
+// list - list objects in bucket with prefix
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := fakeS3ListResult{
+		Name: bucket,
+	}
+	prefix := r.URL.Query().Get("prefix")
+	for path, body := range s.objects {
+		key := strings.TrimPrefix(path, bucket+"/")
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, fakeS3Object{
+				Key:          key,
+				Size:         len(body),
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// decodeAwsChunked - decode streaming signed upload body
+func decodeAwsChunked(body []byte) []byte {
+	decoded := make([]byte, 0, len(body))
+	for len(body) > 0 {
+		end := strings.Index(string(body), "\r\n")
+		if end < 0 {
+			break
+		}
+		size := string(body[:end])
+		if index := strings.Index(size, ";"); index >= 0 {
+			size = size[:index]
+		}
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n == 0 {
+			break
+		}
+		body = body[end+2:]
+		decoded = append(decoded, body[:n]...)
+		body = body[n+2:]
+	}
+	return decoded
+}
+
+// testS3Config - config with file system cache falling back to given s3
+func testS3Config(t *testing.T, host string) Config {
+	config := testConfig(t)
+	config.S3Endpoint = host
+	config.S3Secure = false
+	// s3 items are reloaded in tests
+	config.WarmStart = true
+	config.S3Region = "us-east-1"
+	config.S3AccessKey = "access"
+	config.S3SecretKey = "secret"
+	config.CacheStorageHandlers = []string{CacheStorageFile, CacheStorageS3}
+	config.CacheMaxSize[CacheItemPublic][CacheStorageFile] = 10
+	return config
+}
+
+// storeInS3 - store item that is too large for the file system cache
+func storeInS3(t *testing.T, handler *Handler) *Item {
+	item, err := handler.Store(testResp(testReq("GET", "http://cache.test/s3"), 200, "max-age=864000", strings.Repeat("s3 ", 100), nil))
+	if err != nil || item == nil {
+		t.Fatal("not stored", err)
+	}
+	// moved once it is pooled with the s3 items, its metadata is stored by then
+	waitUntil(t, func() bool {
+		return handler.items.Pool(CacheItemPublic, CacheStorageS3).Size() > 0
+	})
+	return item
+}
+
+func TestS3Storage(t *testing.T) {
+	s3, host := newFakeS3(t)
+	config := testS3Config(t, host)
+	handler := testHandler(t, config)
+	body := strings.Repeat("s3 ", 100)
+	item, err := handler.Store(testResp(testReq("GET", "http://cache.test/s3"), 200, "max-age=864000", body, nil))
+	if err != nil || item == nil {
+		t.Fatal("not stored", err)
+	}
+	// storing another item moves the long lived item to s3
+	handler.Store(testResp(testReq("GET", "http://cache.test/short"), 200, "max-age=60", body, nil))
+	waitUntil(t, func() bool {
+		return item.GetStorageType() == CacheStorageS3
+	})
+	resp, _ := handler.OnRequest(testReq("GET", "http://cache.test/s3"))
+	if resp == nil || readBody(t, resp) != body {
+		t.Fatal("expected hit from s3")
+	}
+	// second handler loads the item from s3
+	reloadConfig := config
+	reloadConfig.CacheFilePath = t.TempDir()
+	reloaded := testHandler(t, reloadConfig)
+	waitUntil(t, func() bool {
+		return reloaded.items.Len() == 1
+	})
+	resp, _ = reloaded.OnRequest(testReq("GET", "http://cache.test/s3"))
+	if resp == nil || readBody(t, resp) != body {
+		t.Fatal("expected hit after reload")
+	}
+	handler.removeItem(item)
+	if s3.Len() != 0 {
+		t.Fatalf("expected s3 objects to be removed, %d left", s3.Len())
+	}
+}
+
+func TestS3LoadInBackground(t *testing.T) {
+	s3, host := newFakeS3(t)
+	config := testS3Config(t, host)
+	handler := testHandler(t, config)
+	storeInS3(t, handler)
+	// listing s3 does not hold up creating the handler
+	listing := make(chan struct{})
+	s3.mutex.Lock()
+	s3.listing = listing
+	s3.mutex.Unlock()
+	reloadConfig := config
+	reloadConfig.CacheFilePath = t.TempDir()
+	reloaded := testHandler(t, reloadConfig)
+	if reloaded.items.Len() != 0 {
+		t.Fatal("expected s3 items to load in the background")
+	}
+	close(listing)
+	waitUntil(t, func() bool {
+		return reloaded.items.Len() == 1
+	})
+}
+
+func TestS3Clear(t *testing.T) {
+	s3, host := newFakeS3(t)
+	config := testS3Config(t, host)
+	handler := testHandler(t, config)
+	storeInS3(t, handler)
+	handler.Clear()
+	if s3.Len() != 0 {
+		t.Fatalf("expected s3 objects to be removed, %d left", s3.Len())
+	}
+	// objects left by a previous run are removed on a cold start
+	s3.mutex.Lock()
+	s3.objects[config.S3Bucket+"/"+config.S3Prefix+"orphan"+CacheItemFileExtension] = []byte("orphan")
+	s3.mutex.Unlock()
+	coldConfig := config
+	coldConfig.WarmStart = false
+	testHandler(t, coldConfig)
+	if s3.Len() != 0 {
+		t.Fatalf("expected orphaned s3 objects to be removed, %d left", s3.Len())
+	}
+}
@@ -0,0 +1,261 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// errStoreAborted - response body was not stored in full
+var errStoreAborted = errors.New("store aborted")
+
+// storeBufferSize - max bytes of a response body buffered for writing to
+// storage, reading the response body only waits on storage once it is full
+const storeBufferSize = 1024 * 1024 // 1MB
+
+// storeResult - result of writing a response body to storage
+type storeResult struct {
+	contentLength int64
+	err           error
+}
+
+// storeBuffer - bounded buffer between reading a response body and writing
+// it to storage, writes only block while the buffer is full
+type storeBuffer struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	buf       bytes.Buffer
+	maxSize   int
+	writeErr  error
+	readErr   error
+	writeDone bool
+	readDone  bool
+}
+
+// newStoreBuffer - create new empty store buffer
+func newStoreBuffer(maxSize int) *storeBuffer {
+	sb := &storeBuffer{maxSize: maxSize}
+	sb.cond = sync.NewCond(&sb.mutex)
+	return sb
+}
+
+// Write - add bytes to buffer, waits while the buffer is full
+func (sb *storeBuffer) Write(p []byte) (int, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	for sb.buf.Len() >= sb.maxSize && !sb.readDone {
+		sb.cond.Wait()
+	}
+	if sb.readDone {
+		return 0, sb.readErr
+	}
+	if sb.writeDone {
+		return 0, io.ErrClosedPipe
+	}
+	sb.buf.Write(p)
+	sb.cond.Broadcast()
+	return len(p), nil
+}
+
+// CloseWithError - stop writing, reads return err, or io.EOF if nil, once
+// the buffer is drained, any other error is returned right away
+func (sb *storeBuffer) CloseWithError(err error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if err == nil {
+		err = io.EOF
+	}
+	sb.writeDone = true
+	sb.writeErr = err
+	sb.cond.Broadcast()
+}
+
+// Read - take bytes from buffer, waits while the buffer is empty
+func (sb *storeBuffer) Read(p []byte) (int, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	for sb.buf.Len() == 0 && !sb.writeDone {
+		sb.cond.Wait()
+	}
+	if sb.writeDone && sb.writeErr != io.EOF {
+		return 0, sb.writeErr
+	}
+	if sb.buf.Len() == 0 {
+		return 0, sb.writeErr
+	}
+	n, _ := sb.buf.Read(p)
+	sb.cond.Broadcast()
+	return n, nil
+}
+
+// CloseRead - stop reading, writes fail with err
+func (sb *storeBuffer) CloseRead(err error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	sb.readDone = true
+	sb.readErr = err
+	sb.cond.Broadcast()
+}
+
+// storeBody - response body that is written to the storage of a new cache
+// item while it is read, the item is added to the cache once the body was
+// read in full, storing is aborted and the partial body discarded if it
+// grows past the max response size or is not read to the end
+type storeBody struct {
+	body    io.ReadCloser
+	buffer  *storeBuffer
+	result  chan storeResult
+	size    int64
+	maxSize int64
+	item    *Item
+	handler *Handler
+	done    bool
+	drain   bool
+	finish  func(item *Item, uncacheable bool)
+}
+
+// newStoreBody - wrap response body so it is stored in given new cache
+// item as it is read, finish is called once storing is done with the
+// cached item or nil if storing was aborted, uncacheable is set if it was
+// aborted because of the response itself
+func (b *Handler) newStoreBody(body io.ReadCloser, item *Item, finish func(item *Item, uncacheable bool)) *storeBody {
+	buffer := newStoreBuffer(storeBufferSize)
+	s := &storeBody{
+		body:    body,
+		buffer:  buffer,
+		result:  make(chan storeResult, 1),
+		maxSize: int64(b.Config.ResponseMaxSize),
+		item:    item,
+		handler: b,
+		finish:  finish,
+	}
+	go func() {
+		contentLength, err := item.storeBody(buffer)
+		buffer.CloseRead(err)
+		s.result <- storeResult{contentLength: contentLength, err: err}
+	}()
+	return s
+}
+
+// Read - read from response body, writing what was read to storage
+func (s *storeBody) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 && !s.done {
+		s.size += int64(n)
+		if s.size > s.maxSize {
+			s.abort("REASON = response too large", true)
+		} else if _, writeErr := s.buffer.Write(p[:n]); writeErr != nil {
+			s.abort("ERROR = "+writeErr.Error(), false)
+		}
+	}
+	if err != nil && !s.done {
+		if err == io.EOF {
+			s.commit()
+		} else {
+			s.abort("ERROR = "+err.Error(), false)
+		}
+	}
+	return n, err
+}
+
+// Close - close response body, storing is aborted if the body was not
+// read in full unless it is set to drain, then the rest of the body is
+// read and stored in the background
+func (s *storeBody) Close() error {
+	if !s.done && s.drain {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for !s.done {
+				s.Read(buf)
+			}
+			s.body.Close()
+		}()
+		return nil
+	}
+	if !s.done {
+		s.abort("REASON = response not read in full", false)
+	}
+	return s.body.Close()
+}
+
+// abort - stop storing response body and discard what was stored
+func (s *storeBody) abort(reason string, uncacheable bool) {
+	s.done = true
+	s.buffer.CloseWithError(errStoreAborted)
+	go func() {
+		<-s.result
+		s.item.LogAction("invalidate", reason)
+		s.item.Clear()
+		s.finish(nil, uncacheable)
+	}()
+}
+
+// commit - finish storing response body and add the cache item, the
+// buffered rest of the body is written to storage without holding up the
+// reader
+func (s *storeBody) commit() {
+	s.done = true
+	s.buffer.CloseWithError(nil)
+	go func() {
+		result := <-s.result
+		if result.err != nil {
+			s.item.LogAction("invalidate", "ERROR = "+result.err.Error())
+			s.item.Clear()
+			s.finish(nil, false)
+			return
+		}
+		cacheItem, err := s.handler.addItem(s.item, result.contentLength)
+		if err != nil {
+			s.item.LogAction("invalidate", "ERROR = "+err.Error())
+			s.finish(nil, false)
+			return
+		}
+		s.finish(cacheItem, false)
+	}()
+}
+
+// storeFull - read response body in full in to the storage of given new
+// cache item, returns the cached item, nil if the response could not be
+// cached or errStoreAborted if it could but was not stored
+func (b *Handler) storeFull(body io.ReadCloser, item *Item) (*Item, error) {
+	type stored struct {
+		item        *Item
+		uncacheable bool
+	}
+	done := make(chan stored, 1)
+	s := b.newStoreBody(body, item, func(storedItem *Item, uncacheable bool) {
+		done <- stored{item: storedItem, uncacheable: uncacheable}
+	})
+	_, err := io.Copy(ioutil.Discard, s)
+	s.Close()
+	result := <-done
+	if err != nil {
+		return nil, err
+	}
+	if result.item == nil && !result.uncacheable {
+		return nil, errStoreAborted
+	}
+	return result.item, nil
+}
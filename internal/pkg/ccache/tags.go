@@ -0,0 +1,50 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// tagRequestHeaderLegacy - request header tags used to be sent in to
+// purge items with xkey
+const tagRequestHeaderLegacy = "Key"
+
+// TagsFromHeader - get distinct tags listed in given headers, each header
+// holds tokens separated by whitespace or commas
+func TagsFromHeader(header http.Header, tagHeaders []string) []string {
+	tags := make([]string, 0)
+	seen := map[string]bool{}
+	for _, headerName := range tagHeaders {
+		for _, value := range header[http.CanonicalHeaderKey(headerName)] {
+			tokens := strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			})
+			for _, tag := range tokens {
+				if seen[tag] {
+					continue
+				}
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
@@ -20,9 +20,12 @@ package ccache
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // HTTPResponseToBytes - convert http response to bytes
@@ -46,6 +49,65 @@ func HTTPResponseFromBytes(b []byte) (*http.Response, error) {
 	)
 }
 
+// uncachedHeaders - response headers that are not stored with a cache item
+var uncachedHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// copyHeader - copy response headers that should be stored with a cache item
+func copyHeader(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for name, values := range header {
+		out[name] = append([]string(nil), values...)
+	}
+	for _, name := range uncachedHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+// uncachedRequestHeaders - request headers holding credentials or
+// sessions that are not stored with a cache item
+var uncachedRequestHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+}
+
+// copyRequestHeader - copy request headers that should be stored with a
+// cache item, used to match bans against the request it was cached for
+func copyRequestHeader(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for name, values := range header {
+		out[name] = append([]string(nil), values...)
+	}
+	for _, name := range uncachedRequestHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+// stringsEqual - check if two string slices are equal
+func stringsEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
+
 // wildcardMatchCharacter - character to use as the wildcard character
 const wildcardMatchCharacter = "*"
 
@@ -59,3 +121,14 @@ func WildcardCompare(original string, test string) bool {
 	}
 	return regex.MatchString(original)
 }
+
+// storageKeyCounter - counter used to keep storage keys unique
+var storageKeyCounter uint64
+
+// newStorageKey - create unique storage key for given cache key
+func newStorageKey(key string) string {
+	return fmt.Sprintf(
+		"%s-%x-%x",
+		key, time.Now().UnixNano(), atomic.AddUint64(&storageKeyCounter, 1),
+	)
+}
@@ -0,0 +1,118 @@
+/*
+This file is part of CProxy-Cache.
+
+CProxy-Cache is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy-Cache is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy-Cache.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ccache
+
+import (
+	"net/http"
+	"testing"
+)
+
+// testVaryReq - create request with given accept-language header
+func testVaryReq(method string, url string, language string) *http.Request {
+	req := testReq(method, url)
+	if language != "" {
+		req.Header.Set("Accept-Language", language)
+	}
+	return req
+}
+
+// testVaryHandler - create cache handler holding an english and a german
+// variant of the same url
+func testVaryHandler(t *testing.T) *Handler {
+	handler := testHandler(t, testConfig(t))
+	for language, body := range map[string]string{"en": "hello", "de": "hallo"} {
+		item, err := handler.Store(testResp(testVaryReq("GET", "http://cache.test/vary", language), 200, "max-age=60", body, map[string]string{
+			"Vary": "accept-language",
+			"Xkey": "greeting",
+		}))
+		if err != nil || item == nil {
+			t.Fatalf("variant '%s' not stored, %v", language, err)
+		}
+	}
+	return handler
+}
+
+func TestVarySplit(t *testing.T) {
+	handler := testVaryHandler(t)
+	if count := handler.items.Len(); count != 2 {
+		t.Fatalf("expected 2 variants, got %d", count)
+	}
+	tests := []struct {
+		language string
+		body     string
+	}{
+		{"en", "hello"},
+		{"de", "hallo"},
+		{"fr", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		body := ""
+		if item := handler.Fetch(testVaryReq("GET", "http://cache.test/vary", test.language)); item != nil {
+			resp, err := handler.serveItem(testVaryReq("GET", "http://cache.test/vary", test.language), item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = readBody(t, resp)
+		}
+		if body != test.body {
+			t.Errorf("'%s': got '%s', want '%s'", test.language, body, test.body)
+		}
+	}
+	// origin changed the headers it varies on, older variants are dropped
+	handler.Store(testResp(testVaryReq("GET", "http://cache.test/vary", "fr"), 200, "max-age=60", "bonjour", map[string]string{
+		"Vary": "Accept-Encoding",
+	}))
+	if count := handler.items.Len(); count != 1 {
+		t.Fatalf("expected 1 variant after vary change, got %d", count)
+	}
+}
+
+func TestVaryPurge(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		header  map[string]string
+		purged  bool
+		removed bool
+	}{
+		{"purge", "PURGE", "http://cache.test/vary", nil, true, true},
+		{"purge with request variant", "PURGE", "http://cache.test/vary", map[string]string{"Accept-Language": "en"}, true, true},
+		{"purge other url", "PURGE", "http://cache.test/other", nil, false, false},
+		{"purge tag", "PURGE", "http://cache.test/", map[string]string{"Xkey": "greeting"}, true, true},
+		{"soft purge", "SOFTPURGE", "http://cache.test/vary", nil, true, false},
+	}
+	for _, test := range tests {
+		handler := testVaryHandler(t)
+		resp, _ := handler.OnRequest(testPurgeReq(test.method, test.url, test.header))
+		if resp == nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: purge request failed", test.name)
+		}
+		// every variant is purged together
+		for _, language := range []string{"en", "de"} {
+			fresh := handler.Fetch(testVaryReq("GET", "http://cache.test/vary", language)) != nil
+			if fresh == test.purged {
+				t.Errorf("%s: variant '%s' fresh %t", test.name, language, fresh)
+			}
+		}
+		if removed := handler.items.Len() == 0; removed != test.removed {
+			t.Errorf("%s: got removed %t, want %t", test.name, removed, test.removed)
+		}
+	}
+}
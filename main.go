@@ -26,7 +26,7 @@ import (
 )
 
 // cacheHandler - cache handler
-var cacheHandler ccache.Handler
+var cacheHandler *ccache.Handler
 
 // GetName - get name of this extension
 func GetName() string {
@@ -51,7 +51,7 @@ func OnLoad(subRequestCallback func(*http.Request) (*http.Response, error), rawC
 
 // OnUnload - unload extension
 func OnUnload() {
-	cacheHandler.Clear()
+	cacheHandler.Close()
 }
 
 // OnRequest - request event